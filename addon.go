@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// When run as a Home Assistant add-on, the user's options arrive as JSON in
+// /data/options.json. OPTIONS_FILE names that file; its keys are the usual
+// settings, in any case (e.g. "serial_port"), and are merged over the config
+// file. Environment variables still take precedence.
+var optionsKeys = map[string]bool{}
+
+func mergeOptionsFile() error {
+	path := viper.GetString("OPTIONS_FILE")
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read options file %s: %v", path, err)
+	}
+	var options map[string]interface{}
+	if err := json.Unmarshal(b, &options); err != nil {
+		return fmt.Errorf("options file %s is not valid JSON: %v", path, err)
+	}
+	for key, value := range options {
+		// The add-on leaves unset optional options as null.
+		if value == nil {
+			delete(options, key)
+			continue
+		}
+		optionsKeys[strings.ToUpper(key)] = true
+	}
+	return viper.MergeConfigMap(options)
+}
+
+// addonServiceEnv maps settings to the variables the Supervisor sets for the
+// add-on's MQTT service. They are fallbacks, used only when the setting is not
+// configured any other way.
+var addonServiceEnv = map[string]string{
+	"MQTT_HOST":     "MQTTHOST",
+	"MQTT_PORT":     "MQTTPORT",
+	"MQTT_USERNAME": "MQTTUSER",
+	"MQTT_PASSWORD": "MQTTPASSWORD",
+}
+
+func applyAddonServiceEnv() {
+	if viper.GetString("MQTT_URL") != "" {
+		return
+	}
+	for key, env := range addonServiceEnv {
+		value, ok := os.LookupEnv(env)
+		if !ok || value == "" {
+			continue
+		}
+		if _, set := os.LookupEnv(key); set || viper.InConfig(key) {
+			continue
+		}
+		viper.Set(key, value)
+	}
+}
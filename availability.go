@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Sensors are grouped per meter; the single-meter setup reports as "meter",
+// matching the prefix of its entity IDs.
+const defaultMeter = "meter"
+
+type meterWatch struct {
+	lastFrame time.Time
+	online    bool
+}
+
+var (
+	meterWatchMu sync.Mutex
+	meterWatches = map[string]*meterWatch{}
+)
+
+// The bridge's own availability goes offline through the MQTT Last Will
+// when emu2mqtt dies, and explicitly when every device's serial port stays
+// down past SERIAL_OFFLINE_GRACE.
+func bridgeAvailabilityTopic() string {
+	return topicPrefix() + "/sensor/emu2mqtt/availability"
+}
+
+var (
+	serialDownMu sync.Mutex
+	serialDown   = map[*emuDevice]bool{}
+)
+
+func publishBridgeAvailability(m Publisher) {
+	serialDownMu.Lock()
+	defer serialDownMu.Unlock()
+	payload := "online"
+	if len(devices) > 0 && len(serialDown) == len(devices) {
+		payload = "offline"
+	}
+	m.Publish(bridgeAvailabilityTopic(), 1, true, payload)
+}
+
+func setSerialDown(m Publisher, dev *emuDevice, down bool) {
+	serialDownMu.Lock()
+	changed := serialDown[dev] != down
+	if down {
+		serialDown[dev] = true
+	} else {
+		delete(serialDown, dev)
+	}
+	serialDownMu.Unlock()
+	if changed {
+		publishBridgeAvailability(m)
+	}
+}
+
+func meterAvailabilityEnabled() bool {
+	return viper.GetDuration("METER_TIMEOUT") > 0
+}
+
+func meterAvailabilityTopic(meter string) string {
+	return topicPrefix() + "/sensor/" + meter + "/availability"
+}
+
+func markMeterSeen(m Publisher, meter string) {
+	if !meterAvailabilityEnabled() {
+		return
+	}
+	meterWatchMu.Lock()
+	defer meterWatchMu.Unlock()
+
+	w, ok := meterWatches[meter]
+	if !ok {
+		w = &meterWatch{}
+		meterWatches[meter] = w
+	}
+	w.lastFrame = clock.Now()
+	if !w.online {
+		w.online = true
+		log.Printf("Meter %s is reporting, marking online", meter)
+		m.Publish(meterAvailabilityTopic(meter), 0, true, "online")
+	}
+}
+
+func watchMeterAvailability(m Publisher) {
+	timeout := viper.GetDuration("METER_TIMEOUT")
+	if timeout <= 0 {
+		return
+	}
+	ticker := clock.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C() {
+		meterWatchMu.Lock()
+		for meter, w := range meterWatches {
+			if silent := clock.Now().Sub(w.lastFrame); w.online && silent > timeout {
+				w.online = false
+				log.Printf("Meter %s silent for %v, marking offline", meter, silent.Round(time.Second))
+				m.Publish(meterAvailabilityTopic(meter), 0, true, "offline")
+			}
+		}
+		meterWatchMu.Unlock()
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// BlockPriceDetail describes block (tiered) pricing: the consumption so far
+// in the block period and the price of each block. The per-block thresholds
+// and prices, e.g. <Block1Threshold> and <Block2Price>, are numbered, so
+// they are collected from the remaining elements.
+type BlockPriceDetail struct {
+	XMLName                          xml.Name `xml:"BlockPriceDetail"`
+	DeviceMacId                      string   `xml:"DeviceMacId"`
+	MeterMacId                       string   `xml:"MeterMacId"`
+	TimeStamp                        string   `xml:"TimeStamp"`
+	CurrentStart                     string   `xml:"CurrentStart"`
+	CurrentDuration                  string   `xml:"CurrentDuration"`
+	BlockPeriodConsumption           string   `xml:"BlockPeriodConsumption"`
+	BlockPeriodConsumptionMultiplier string   `xml:"BlockPeriodConsumptionMultiplier"`
+	BlockPeriodConsumptionDivisor    string   `xml:"BlockPeriodConsumptionDivisor"`
+	CurrentBlock                     string   `xml:"CurrentBlock"`
+	NumberOfBlocks                   string   `xml:"NumberOfBlocks"`
+	Multiplier                       string   `xml:"Multiplier"`
+	Divisor                          string   `xml:"Divisor"`
+	Currency                         string   `xml:"Currency"`
+	TrailingDigits                   string   `xml:"TrailingDigits" validate:"required,emuhex"`
+	Blocks                           []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// Time-of-use meters with block pricing price each block per tier, e.g.
+// <Tier2Block1Price>; the others send plain <Block1Price>.
+var (
+	blockPriceField     = regexp.MustCompile(`^(?:Tier(?P<tier>\d+))?Block(?P<block>\d+)Price$`)
+	blockThresholdField = regexp.MustCompile(`^Block(?P<block>\d+)Threshold$`)
+)
+
+// blockFields returns the numbered per-block fields matching pattern in the
+// given price tier, keyed by block number; tier 0 is the untiered fields.
+// Invalid and unset (all ones) values are left out.
+func (b BlockPriceDetail) blockFields(pattern *regexp.Regexp, tier int) map[int]int64 {
+	fields := map[int]int64{}
+	for _, f := range b.Blocks {
+		match := pattern.FindStringSubmatch(f.XMLName.Local)
+		if match == nil || allOnes(f.Value) {
+			continue
+		}
+		fieldTier := 0
+		if i := pattern.SubexpIndex("tier"); i >= 0 && match[i] != "" {
+			fieldTier, _ = strconv.Atoi(match[i])
+		}
+		if fieldTier != tier {
+			continue
+		}
+		v, err := parseHex(f.Value)
+		if err != nil {
+			slog.Warn("Ignoring invalid block field", "field", f.XMLName.Local, "value", f.Value)
+			continue
+		}
+		n, _ := strconv.Atoi(match[pattern.SubexpIndex("block")])
+		fields[n] = v
+	}
+	return fields
+}
+
+// currentBlock is the block the consumption is in. Meters that do not send
+// CurrentBlock have it worked out from the thresholds; a meter with a single
+// block is always in block 1.
+func (b BlockPriceDetail) currentBlock(consumption float64, thresholds map[int]float64) int {
+	if b.CurrentBlock != "" {
+		if n, err := parseHex(b.CurrentBlock); err == nil && n > 0 {
+			return int(n)
+		}
+	}
+	block := 1
+	if math.IsNaN(consumption) {
+		return block
+	}
+	for n, threshold := range thresholds {
+		// Block n's threshold is where block n+1 starts.
+		if consumption >= threshold && n+1 > block {
+			block = n + 1
+		}
+	}
+	return block
+}
+
+// scaled applies a frame's multiplier and divisor, either of which may be
+// missing.
+func scaled(v int64, multiplier, divisor string) float64 {
+	if mult, div, err := parseScale(multiplier, divisor); err == nil {
+		return float64(v) * mult / div
+	}
+	return float64(v)
+}
+
+func handleBlockPriceDetail(fc *frameContext, data []byte) {
+	var detail BlockPriceDetail
+	if err := fc.decode(data, &detail); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if !fc.dev.primary() || sparkplugEnabled() {
+		return
+	}
+	digits, err := parseHex(detail.TrailingDigits)
+	if err != nil {
+		fc.malformed("BlockPriceDetail", err)
+		return
+	}
+
+	consumption := math.NaN()
+	if detail.BlockPeriodConsumption != "" && !allOnes(detail.BlockPeriodConsumption) {
+		if v, err := parseHex(detail.BlockPeriodConsumption); err == nil {
+			consumption = scaled(v, detail.BlockPeriodConsumptionMultiplier, detail.BlockPeriodConsumptionDivisor)
+		}
+	}
+	thresholds := map[int]float64{}
+	for n, v := range detail.blockFields(blockThresholdField, 0) {
+		thresholds[n] = scaled(v, detail.Multiplier, detail.Divisor)
+	}
+	block := detail.currentBlock(consumption, thresholds)
+
+	numbers := make([]int, 0, len(thresholds))
+	for n := range thresholds {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	thresholdList := make([]float64, 0, len(numbers))
+	for _, n := range numbers {
+		thresholdList = append(thresholdList, thresholds[n])
+	}
+	attrs := map[string]interface{}{
+		"number_of_blocks":         nil,
+		"block_period_consumption": nil,
+		"thresholds":               thresholdList,
+	}
+	if n, err := parseHex(detail.NumberOfBlocks); err == nil {
+		attrs["number_of_blocks"] = n
+	}
+	if !math.IsNaN(consumption) {
+		attrs["block_period_consumption"] = consumption
+	}
+	b, _ := json.Marshal(attrs)
+	fc.m.Publish(attributesTopic("meter_price_block"), 0, true, b)
+	fc.m.Publish(stateTopic("meter_price_block"), 0, true, strconv.Itoa(block))
+
+	// The tier in effect is the one of the meter's latest PriceCluster.
+	tier := int(priceTier.Load())
+	price, ok := detail.blockFields(blockPriceField, tier)[block]
+	if !ok && tier != 0 {
+		price, ok = detail.blockFields(blockPriceField, 0)[block]
+	}
+	if !ok {
+		slog.Debug("No price for the current block", "block", block, "tier", tier)
+		return
+	}
+	if setCurrency(detail.Currency) {
+		setupMQTTDiscovery(fc.m)
+	}
+	value := float64(price) / math.Pow10(int(digits))
+	fc.m.Publish(stateTopic("meter_block_price"), 0, true, strconv.FormatFloat(value, 'f', int(digits), 64))
+}
@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// Clock is the source of time for everything the bridge times or stamps:
+// the aggregates, throttle and duplicate suppression, the discovery backoff,
+// serial retries and the offline grace period, meter availability, the
+// watchdog, re-request limits, periodic saves and counters, the broker seed
+// timeout, and reading timestamps. Only waits on MQTT tokens use the wall
+// clock, alongside the client's own timeouts. It is a variable so the time
+// can be controlled without waiting on the wall clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a pending AfterFunc call.
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker delivers the time every period, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+var clock Clock = realClock{}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// fakeClock is a Clock that only moves when told to. Timers and After
+// channels fire from advance, in deadline order, on the calling goroutine.
+// With auto set, After moves the clock on by itself, for code that blocks
+// waiting on it.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	auto   bool
+}
+
+type fakeTimer struct {
+	c  *fakeClock
+	at time.Time
+	f  func()
+}
+
+// useFakeClock installs a fakeClock reading start for the rest of the test.
+func useFakeClock(t *testing.T, start time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: start}
+	clock = c
+	t.Cleanup(func() { clock = realClock{} })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() { ch <- c.Now() })
+	if c.auto {
+		c.advance(d)
+	}
+	return ch
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, pending := range t.c.timers {
+		if pending == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTicker fires on the fake clock's timers, rescheduling itself each
+// tick. Like time.Ticker, it drops ticks nobody was ready for.
+type fakeTicker struct {
+	c     chan time.Time
+	mu    sync.Mutex
+	timer Timer
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	t := &fakeTicker{c: make(chan time.Time, 1)}
+	var tick func()
+	tick = func() {
+		select {
+		case t.c <- c.Now():
+		default:
+		}
+		t.mu.Lock()
+		if t.timer != nil {
+			t.timer = c.AfterFunc(d, tick)
+		}
+		t.mu.Unlock()
+	}
+	t.mu.Lock()
+	t.timer = c.AfterFunc(d, tick)
+	t.mu.Unlock()
+	return t
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// set moves the clock to now, which may be earlier, without firing timers.
+func (c *fakeClock) set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// advance moves the clock forward by d, running every timer that falls due
+// with the clock reading its deadline.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.mu.Unlock()
+		t.f()
+	}
+}
+
+func TestFakeClockFiresTimersInOrder(t *testing.T) {
+	c := useFakeClock(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var fired []time.Duration
+	start := c.Now()
+	clock.AfterFunc(3*time.Second, func() { fired = append(fired, clock.Now().Sub(start)) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, clock.Now().Sub(start)) })
+	stopped := clock.AfterFunc(2*time.Second, func() { t.Error("stopped timer fired") })
+	stopped.Stop()
+	after := clock.After(5 * time.Second)
+
+	c.advance(4 * time.Second)
+	if len(fired) != 2 || fired[0] != time.Second || fired[1] != 3*time.Second {
+		t.Errorf("timers fired at %v, want [1s 3s]", fired)
+	}
+	select {
+	case <-after:
+		t.Fatal("After fired early")
+	default:
+	}
+	c.advance(time.Second)
+	if got := <-after; !got.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("After delivered %v", got)
+	}
+}
+
+func TestFrameTooOldUsesClock(t *testing.T) {
+	resetBridge(t)
+	viper.Set("MAX_FRAME_AGE_SECONDS", 60)
+	// 0x2c3a1b00 is 2023-07-07T00:38:24Z.
+	frame := time.Date(2023, 7, 7, 0, 38, 24, 0, time.UTC)
+	c := useFakeClock(t, frame.Add(59*time.Second))
+
+	if frameTooOld("InstantaneousDemand", "0x2c3a1b00") {
+		t.Error("59s old frame discarded")
+	}
+	c.advance(2 * time.Second)
+	if !frameTooOld("InstantaneousDemand", "0x2c3a1b00") {
+		t.Error("61s old frame kept")
+	}
+}
+
+func TestReadyUsesClock(t *testing.T) {
+	resetBridge(t)
+	viper.Set("HEALTH_FRAME_MAX_AGE", time.Minute)
+	c := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	health.mqttConnected.Store(true)
+	t.Cleanup(func() {
+		health.mqttConnected.Store(false)
+		health.lastFrame.Store(0)
+	})
+
+	markFrameReceived()
+	c.advance(time.Minute)
+	if ok, reason := ready(); !ok {
+		t.Errorf("not ready a minute after a frame: %s", reason)
+	}
+	c.advance(time.Second)
+	if ok, _ := ready(); ok {
+		t.Error("still ready after HEALTH_FRAME_MAX_AGE without a frame")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	c := useFakeClock(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := c.Now()
+	ticker := clock.NewTicker(time.Minute)
+	for i := 1; i <= 2; i++ {
+		c.advance(time.Minute)
+		if got := <-ticker.C(); got.Sub(start) != time.Duration(i)*time.Minute {
+			t.Errorf("tick %d at %v", i, got.Sub(start))
+		}
+	}
+	ticker.Stop()
+	c.advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker ticked")
+	default:
+	}
+}
+
+func TestMeterAvailabilityUsesClock(t *testing.T) {
+	resetBridge(t)
+	viper.Set("METER_TIMEOUT", time.Minute)
+	c := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	rec := &recordingPublisher{}
+	meterWatchMu.Lock()
+	meterWatches = map[string]*meterWatch{}
+	meterWatchMu.Unlock()
+
+	markMeterSeen(rec, "meter")
+	go watchMeterAvailability(rec)
+	topic := meterAvailabilityTopic("meter")
+	// Let the watcher start its ticker before the clock moves on.
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.timers)
+		c.mu.Unlock()
+		if waiting > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.advance(time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if got, _ := rec.last(topic); got != "online" {
+		t.Fatalf("meter marked %q a minute after its last frame", got)
+	}
+	c.advance(15 * time.Second)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if got, _ := rec.last(topic); got == "offline" {
+			return
+		}
+	}
+	t.Error("meter not marked offline after METER_TIMEOUT")
+}
+
+func TestRerequestLimitUsesClock(t *testing.T) {
+	resetBridge(t)
+	viper.Set("REREQUEST_INVALID", true)
+	viper.Set("REREQUEST_MIN_INTERVAL", time.Minute)
+	c := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	rerequestMu.Lock()
+	lastRerequest = map[string]time.Time{}
+	rerequestMu.Unlock()
+
+	var w bytes.Buffer
+	rerequestFrame(&w, "get_instantaneous_demand")
+	c.advance(59 * time.Second)
+	rerequestFrame(&w, "get_instantaneous_demand")
+	c.advance(time.Second)
+	rerequestFrame(&w, "get_instantaneous_demand")
+	if n := strings.Count(w.String(), "get_instantaneous_demand"); n != 2 {
+		t.Errorf("sent %d re-requests in a minute, want 2:\n%s", n, w.String())
+	}
+}
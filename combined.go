@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// With PUBLISH_MODE json, a device's demand and energy totals are published
+// together as one object on its own state topic, e.g.
+// {"demand":1234,"delivered":123.456,"received":0,"net":123.456,"timestamp":"..."}, and
+// the discovery configs pick their field out with a value_template.
+func jsonPublishMode() bool {
+	return viper.GetString("PUBLISH_MODE") == "json"
+}
+
+func combinedStateTopic(dev *emuDevice) string {
+	return stateTopic(dev.Prefix)
+}
+
+// combinedState holds the latest value of each field, so every publish
+// carries the whole object.
+type combinedState struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func (c *combinedState) update(m Publisher, dev *emuDevice, fields map[string]string) {
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = map[string]interface{}{}
+	}
+	for name, value := range fields {
+		c.values[name] = json.Number(value)
+	}
+	c.values["timestamp"] = formatTimestamp(clock.Now())
+	b, _ := json.Marshal(c.values)
+	c.mu.Unlock()
+	throttle.publish(m, combinedStateTopic(dev), viper.GetBool("RETAIN_STATE"), b)
+}
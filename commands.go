@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// Writes to the EMU-2 are serialized so commands from the poll topic never
+// interleave with the startup sequence.
+var serialWriteMu sync.Mutex
+
+// The port the poll topic writes to; it changes when the port is reopened,
+// and is nil when INPUT_SOURCE is not the serial port.
+var (
+	portMu sync.Mutex
+	port   io.Writer
+)
+
+func setActivePort(w io.Writer) {
+	portMu.Lock()
+	defer portMu.Unlock()
+	port = w
+}
+
+func activePort() io.Writer {
+	portMu.Lock()
+	defer portMu.Unlock()
+	return port
+}
+
+var commandToken = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// sendCommand writes an EMU-2 command. Besides a bare name such as
+// "initialize", cmd may carry arguments as Key=Value pairs, e.g.
+// "set_fast_poll Frequency=0x04 Duration=0x0F", each written as its own
+// element.
+func sendCommand(w io.Writer, cmd string) error {
+	if w == nil {
+		return errors.New("no EMU-2 serial port to send to")
+	}
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 || !commandToken.MatchString(fields[0]) {
+		return fmt.Errorf("invalid command %q", cmd)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<Command>\r\n<Name>%s</Name>\r\n", fields[0])
+	for _, arg := range fields[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || !commandToken.MatchString(key) || !commandToken.MatchString(value) {
+			return fmt.Errorf("invalid argument %q in command %q", arg, cmd)
+		}
+		fmt.Fprintf(&b, "<%s>%s</%s>\r\n", key, value, key)
+	}
+	b.WriteString("</Command>\r\n")
+
+	serialWriteMu.Lock()
+	defer serialWriteMu.Unlock()
+
+	// The command goes out in one write so the EMU-2 never sees a partial
+	// element followed by a command from another goroutine.
+	n, err := w.Write([]byte(b.String()))
+	if err == nil && n < b.Len() {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+func sendStartupCommands(w io.Writer) {
+	for _, name := range viper.GetStringSlice("STARTUP_COMMANDS") {
+		if err := sendCommand(w, name); err != nil {
+			log.Print("Failed sending startup command ", name, ": ", err)
+		}
+	}
+}
+
+func subscribePoll(m mqtt.Client) {
+	topic := viper.GetString("POLL_TOPIC")
+	if topic == "" {
+		return
+	}
+	token := m.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		var names []string
+		switch strings.TrimSpace(strings.ToLower(string(msg.Payload()))) {
+		case "demand":
+			names = []string{"get_instantaneous_demand"}
+		case "summation":
+			names = []string{"get_current_summation_delivered"}
+		case "":
+			names = []string{"get_current_summation_delivered", "get_instantaneous_demand"}
+		default:
+			log.Printf("Ignoring unknown poll request %q", msg.Payload())
+			return
+		}
+		for _, name := range names {
+			if err := sendCommand(activePort(), name); err != nil {
+				log.Print("Failed sending poll command ", name, ": ", err)
+			}
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Print("Failed subscribing to poll topic: ", token.Error())
+	}
+}
+
+var (
+	rerequestMu   sync.Mutex
+	lastRerequest = map[string]time.Time{}
+)
+
+// An incomplete frame otherwise leaves a gap until the next broadcast, so ask
+// the EMU-2 for a fresh one, at most once per REREQUEST_MIN_INTERVAL.
+func rerequestFrame(w io.Writer, name string) {
+	if !viper.GetBool("REREQUEST_INVALID") || w == nil {
+		return
+	}
+	rerequestMu.Lock()
+	if clock.Now().Sub(lastRerequest[name]) < viper.GetDuration("REREQUEST_MIN_INTERVAL") {
+		rerequestMu.Unlock()
+		return
+	}
+	lastRerequest[name] = clock.Now()
+	rerequestMu.Unlock()
+
+	slog.Debug("Re-requesting frame after validation failure", "command", name)
+	if err := sendCommand(w, name); err != nil {
+		log.Print("Failed sending ", name, ": ", err)
+	}
+}
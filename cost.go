@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	priceMu    sync.Mutex
+	meterPrice *float64
+)
+
+func setMeterPrice(p float64) {
+	priceMu.Lock()
+	defer priceMu.Unlock()
+	meterPrice = &p
+}
+
+// currentRate is the $/kWh used for cost tracking: the meter's broadcast
+// price when it sends one, otherwise the user-supplied FLAT_RATE.
+func currentRate() (float64, bool) {
+	priceMu.Lock()
+	defer priceMu.Unlock()
+	if meterPrice != nil {
+		return *meterPrice, true
+	}
+	if viper.IsSet("FLAT_RATE") {
+		return viper.GetFloat64("FLAT_RATE"), true
+	}
+	return 0, false
+}
+
+func costTrackingEnabled() bool {
+	return viper.IsSet("FLAT_RATE") || viper.GetBool("COST_FROM_PRICE")
+}
+
+// accumulateCost adds the cost of the energy delivered since the previous
+// summation. The running total and its baseline are persisted so a restart
+// neither loses nor double-counts consumption.
+func accumulateCost(m Publisher, delivered float64) {
+	if !costTrackingEnabled() {
+		return
+	}
+	rate, ok := currentRate()
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	if persisted.CostBaselineSet && ok {
+		if delta := delivered - persisted.CostBaselineKWh; delta > 0 {
+			persisted.CostTotal += delta * rate
+		}
+	}
+	persisted.CostBaselineKWh = delivered
+	persisted.CostBaselineSet = true
+	stateDirty = true
+
+	m.Publish(stateTopic("meter_cost_total"), 0, true, fmt.Sprintf("%.2f", persisted.CostTotal))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// costRateTracker combines the latest demand with the current price into an
+// instantaneous cost per hour. Demand and price arrive in separate frames, in
+// either order; nothing is published until both are known.
+type costRateTracker struct {
+	mu    sync.Mutex
+	watts *int
+}
+
+var costRate costRateTracker
+
+func (c *costRateTracker) setDemand(m Publisher, watts int) {
+	c.mu.Lock()
+	c.watts = &watts
+	c.mu.Unlock()
+	c.publish(m)
+}
+
+func (c *costRateTracker) publish(m Publisher) {
+	if sparkplugEnabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rate, ok := currentRate()
+	if !ok || c.watts == nil {
+		return
+	}
+	publishState(m, stateTopic("meter_cost_rate"), false, fmt.Sprintf("%.4f", float64(*c.watts)/1000*rate))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// frameCounts tallies frames since startup for the diagnostic counter
+// sensors; a counter that stops rising means the EMU-2 went quiet even if
+// MQTT is fine. They restart from zero with the process.
+var frameCounts = map[string]*atomic.Int64{
+	"InstantaneousDemand":       new(atomic.Int64),
+	"CurrentSummationDelivered": new(atomic.Int64),
+	"TimeCluster":               new(atomic.Int64),
+}
+
+var invalidFrames atomic.Int64
+
+// frameCounterIDs maps each counted frame type to its sensor.
+var frameCounterIDs = map[string]string{
+	"InstantaneousDemand":       "emu2mqtt_frames_demand",
+	"CurrentSummationDelivered": "emu2mqtt_frames_summation",
+	"TimeCluster":               "emu2mqtt_frames_time",
+}
+
+func countFrame(name string) {
+	if c, ok := frameCounts[name]; ok {
+		c.Add(1)
+	}
+}
+
+func countInvalidFrame() {
+	invalidFrames.Add(1)
+}
+
+// publishFrameCounts publishes the counters every FRAME_COUNTS_INTERVAL.
+func publishFrameCounts(m Publisher) {
+	interval := viper.GetDuration("FRAME_COUNTS_INTERVAL")
+	if interval <= 0 || sparkplugEnabled() {
+		return
+	}
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		for name, id := range frameCounterIDs {
+			m.Publish(stateTopic(id), 0, true, strconv.FormatInt(frameCounts[name].Load(), 10))
+		}
+		m.Publish(stateTopic("emu2mqtt_frames_invalid"), 0, true, strconv.FormatInt(invalidFrames.Load(), 10))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// localMidnight returns the start of t's day in the configured timezone.
+// Unlike alignedStart it builds the wall-clock time, since a day containing a
+// DST change is not 24 hours long.
+func localMidnight(t time.Time) time.Time {
+	y, m, d := t.In(location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, location)
+}
+
+// updateDailyEnergy accumulates the energy delivered since local midnight.
+// It sums the deltas between summations rather than subtracting a midnight
+// reading, so a meter counter that rolls over or resets mid-day only loses
+// the one interval in which it happened. The total and its baseline are
+// persisted so a restart keeps today's figure.
+func updateDailyEnergy(m Publisher, delivered float64, timestamp string) {
+	if !viper.GetBool("DAILY_ENERGY") {
+		return
+	}
+	t, err := parseEmuTimestamp(timestamp)
+	if err != nil {
+		t = clock.Now()
+	}
+	day := localMidnight(t)
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	var delta float64
+	if persisted.DayBaselineSet && delivered >= persisted.DayBaselineKWh {
+		delta = delivered - persisted.DayBaselineKWh
+	}
+	persisted.DayBaselineKWh = delivered
+	persisted.DayBaselineSet = true
+
+	if day.After(persisted.DayStart) {
+		persisted.PreviousDayKWh = persisted.DayEnergyKWh
+		persisted.DayStart = day
+		persisted.DayEnergyKWh = 0
+	}
+	persisted.DayEnergyKWh += delta
+	stateDirty = true
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"day_start":        formatTimestamp(persisted.DayStart),
+		"previous_day_kwh": persisted.PreviousDayKWh,
+	})
+	m.Publish(attributesTopic("meter_energy_delivered_today"), 0, true, b)
+	m.Publish(stateTopic("meter_energy_delivered_today"), 0, true, formatEnergy(persisted.DayEnergyKWh))
+}
+
+// seedDailyEnergy restores today's total from the broker for
+// SEED_FROM_BROKER, so a stateless restart does not start the day again at
+// zero. The retained delivered summation becomes the baseline the next delta
+// is taken from. A baseline restored from STATE_FILE wins, and a retained
+// total from an earlier day is ignored.
+func seedDailyEnergy(delivered, today *float64, attributes []byte) {
+	if delivered == nil || today == nil || attributes == nil {
+		return
+	}
+	var attrs struct {
+		DayStart       time.Time `json:"day_start"`
+		PreviousDayKWh float64   `json:"previous_day_kwh"`
+	}
+	if err := json.Unmarshal(attributes, &attrs); err != nil {
+		log.Print("Ignoring retained daily energy attributes: ", err)
+		return
+	}
+	if !attrs.DayStart.Equal(localMidnight(clock.Now())) {
+		return
+	}
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	if persisted.DayBaselineSet {
+		return
+	}
+	persisted.DayStart = attrs.DayStart
+	persisted.DayEnergyKWh = *today
+	persisted.PreviousDayKWh = attrs.PreviousDayKWh
+	persisted.DayBaselineKWh, persisted.DayBaselineSet = *delivered, true
+	log.Printf("Seeded today's energy from broker: %.3f kWh", *today)
+}
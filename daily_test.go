@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// emuTimestamp renders t the way the EMU-2 does, in seconds since 2000.
+func emuTimestamp(t time.Time) string {
+	return fmt.Sprintf("0x%08x", t.Unix()-emuEpochOffset)
+}
+
+func TestDailyEnergyMidnightReset(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		readings []string // local time and kWh delivered, "2006-01-02 15:04:05 kWh"
+		today    []string
+		previous []float64
+	}{
+		{
+			name: "ordinary day",
+			readings: []string{
+				"2024-06-01 23:59:50 100",
+				"2024-06-01 23:59:59 101",
+				"2024-06-02 00:00:01 102.5",
+				"2024-06-02 12:00:00 110",
+			},
+			today:    []string{"0.000", "1.000", "1.500", "9.000"},
+			previous: []float64{0, 0, 1, 1},
+		},
+		{
+			// 23 hours long: midnight is still where the day turns.
+			name: "spring forward",
+			readings: []string{
+				"2024-03-09 23:59:00 100",
+				"2024-03-10 00:00:30 101",
+				"2024-03-10 03:30:00 102",
+				"2024-03-10 23:59:30 104",
+				"2024-03-11 00:00:30 105",
+			},
+			today:    []string{"0.000", "1.000", "2.000", "4.000", "1.000"},
+			previous: []float64{0, 0, 0, 0, 4},
+		},
+		{
+			// 25 hours long: no reset at 23:00, 24 hours after midnight.
+			name: "fall back",
+			readings: []string{
+				"2024-11-03 00:00:10 200",
+				"2024-11-03 01:30:00 201",
+				"2024-11-03 23:30:00 205",
+				"2024-11-04 00:00:10 206",
+			},
+			today:    []string{"0.000", "1.000", "5.000", "1.000"},
+			previous: []float64{0, 0, 0, 5},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, rec := testFrameContext(t)
+			viper.Set("DAILY_ENERGY", true)
+			viper.Set("TIMEZONE", "America/New_York")
+			if err := loadTimezone(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { location = time.UTC })
+
+			for i, reading := range tc.readings {
+				var date, clockTime string
+				var kwh float64
+				fmt.Sscan(reading, &date, &clockTime, &kwh)
+				at, err := time.ParseInLocation("2006-01-02 15:04:05", date+" "+clockTime, location)
+				if err != nil {
+					t.Fatal(err)
+				}
+				updateDailyEnergy(rec, kwh, emuTimestamp(at))
+
+				got, _ := rec.last(stateTopic("meter_energy_delivered_today"))
+				attrs, _ := rec.last(attributesTopic("meter_energy_delivered_today"))
+				var a struct {
+					DayStart       string  `json:"day_start"`
+					PreviousDayKWh float64 `json:"previous_day_kwh"`
+				}
+				json.Unmarshal([]byte(attrs), &a)
+				if got != tc.today[i] || a.PreviousDayKWh != tc.previous[i] {
+					t.Errorf("%s: today %s, previous %v; want %s, %v", reading, got, a.PreviousDayKWh, tc.today[i], tc.previous[i])
+				}
+				if want := localMidnight(at).Format(time.RFC3339); a.DayStart != want {
+					t.Errorf("%s: day_start %s, want %s", reading, a.DayStart, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSeedDailyEnergy(t *testing.T) {
+	now := time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		dayStart time.Time
+		want     string // today's energy after another kWh
+	}{
+		{"retained today", time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC), "10.000"},
+		{"retained yesterday", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "0.000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, rec := testFrameContext(t)
+			viper.Set("DAILY_ENERGY", true)
+			useFakeClock(t, now)
+
+			delivered, today := 110.0, 9.0
+			attrs, _ := json.Marshal(map[string]interface{}{"day_start": formatTimestamp(tc.dayStart), "previous_day_kwh": 5})
+			seedDailyEnergy(&delivered, &today, attrs)
+			updateDailyEnergy(rec, 111, emuTimestamp(now))
+
+			if got, _ := rec.last(stateTopic("meter_energy_delivered_today")); got != tc.want {
+				t.Errorf("today's energy is %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
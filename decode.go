@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// tablePublisher prints each state a frame produces as a row of a table,
+// labelled with the frame it came from. Discovery, attributes and
+// availability are left out.
+type tablePublisher struct {
+	w         *tabwriter.Writer
+	frame     string
+	timestamp string
+	rows      int
+}
+
+func (t *tablePublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	prefix := topicPrefix() + "/sensor/"
+	if strings.HasPrefix(topic, prefix) && strings.HasSuffix(topic, "/state") {
+		if b, ok := payload.([]byte); ok {
+			payload = string(b)
+		}
+		sensor := strings.TrimSuffix(strings.TrimPrefix(topic, prefix), "/state")
+		fmt.Fprintf(t.w, "%s\t%s\t%s\t%v\n", t.frame, t.timestamp, sensor, payload)
+		t.rows++
+	}
+	return &mqtt.DummyToken{}
+}
+
+// decodeCapture runs a captured EMU-2 stream through the frame parser and
+// prints what each frame would publish, without a broker or serial port.
+// Nothing is written to STATE_FILE or the cloud sink, raw frames are not
+// forwarded, frames are not counted, and every reading gets a row however
+// soon it repeats.
+func decodeCapture(dev *emuDevice, r io.Reader, out io.Writer) error {
+	for _, key := range []string{"STATE_FILE", "CLOUD_SINK"} {
+		viper.Set(key, "")
+	}
+	viper.Set("PUBLISH_RAW", false)
+	viper.Set("SUPPRESS_DUPLICATES", false)
+	viper.Set("PUBLISH_MIN_INTERVAL", 0)
+
+	t := &tablePublisher{w: tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)}
+	fc := &frameContext{m: t, dev: dev, decoding: true}
+	fmt.Fprintln(t.w, "FRAME\tTIMESTAMP\tSENSOR\tVALUE")
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(splitFrames)
+	scanner.Buffer(make([]byte, viper.GetInt("SERIAL_BUFFER_BYTES")), bufio.MaxScanTokenSize)
+	for scanner.Scan() {
+		data := scanner.Bytes()
+		t.frame, t.timestamp, t.rows = frameName(data), "-", 0
+		var frame struct {
+			TimeStamp string
+		}
+		if xml.Unmarshal(data, &frame) == nil {
+			if ts, err := parseEmuTimestamp(frame.TimeStamp); err == nil {
+				t.timestamp = formatTimestamp(ts)
+			}
+		}
+		dispatchFrame(fc, data)
+		if t.rows == 0 {
+			fmt.Fprintf(t.w, "%s\t%s\t-\t-\n", t.frame, t.timestamp)
+		}
+	}
+	if err := t.w.Flush(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// runDecode implements "emu2mqtt decode <file>".
+func runDecode(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: emu2mqtt decode <file>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return decodeCapture(primaryDevice(), f, os.Stdout)
+}
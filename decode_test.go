@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDecodeCaptureHasNoSideEffects(t *testing.T) {
+	resetBridge(t)
+	demandCharge = demandChargeTracker{}
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"cost_total":12.5}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("STATE_FILE", path)
+	viper.Set("DEMAND_CHARGE", true)
+	viper.Set("PUBLISH_RAW", true)
+	demands := frameCounts["InstantaneousDemand"].Load()
+	invalid := invalidFrames.Load()
+	dropped := duplicatesDropped.Load()
+	later := strings.Replace(demandFrame, "0x2c3a1b00", "0x2c3a1b08", 1)
+
+	var out strings.Builder
+	if err := decodeCapture(primaryDevice(), strings.NewReader(demandFrame+demandFrame+"<Junk>\r\n</Junk>\r\n"+later), &out); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != `{"cost_total":12.5}` {
+		t.Errorf("decode rewrote STATE_FILE: %s", b)
+	}
+	if frameCounts["InstantaneousDemand"].Load() != demands || invalidFrames.Load() != invalid || duplicatesDropped.Load() != dropped {
+		t.Error("decode counted frames")
+	}
+	if strings.Contains(out.String(), "raw") {
+		t.Errorf("decode forwarded raw frames:\n%s", out.String())
+	}
+	if rows := strings.Count(out.String(), "meter_power_demand "); rows != 2 {
+		t.Errorf("got %d demand rows, want 2:\n%s", rows, out.String())
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type demandSample struct {
+	t     time.Time
+	watts float64
+}
+
+// timeWeightedAverage weights each sample by how long it was current; the
+// last sample is held until now.
+func timeWeightedAverage(samples []demandSample, now time.Time) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	span := now.Sub(samples[0].t)
+	if span <= 0 {
+		return samples[len(samples)-1].watts
+	}
+	var sum float64
+	for i, s := range samples {
+		next := now
+		if i+1 < len(samples) {
+			next = samples[i+1].t
+		}
+		sum += s.watts * next.Sub(s.t).Seconds()
+	}
+	return sum / span.Seconds()
+}
+
+// rollingDemand smooths the raw demand for graphs: with
+// DEMAND_AVERAGE_SECONDS set, each reading also publishes the time-weighted
+// average over that many trailing seconds.
+type rollingDemand struct {
+	mu      sync.Mutex
+	samples []demandSample
+}
+
+func (r *rollingDemand) add(m Publisher, dev *emuDevice, watts float64) {
+	window := time.Duration(viper.GetInt("DEMAND_AVERAGE_SECONDS")) * time.Second
+	if window <= 0 {
+		return
+	}
+	now := clock.Now()
+
+	r.mu.Lock()
+	r.samples = append(r.samples, demandSample{t: now, watts: watts})
+	for len(r.samples) > 1 && !r.samples[1].t.After(now.Add(-window)) {
+		r.samples = r.samples[1:]
+	}
+	samples := append([]demandSample{}, r.samples...)
+	r.mu.Unlock()
+
+	if samples[0].t.Before(now.Add(-window)) {
+		samples[0].t = now.Add(-window)
+	}
+	average := timeWeightedAverage(samples, now)
+	throttle.publish(m, stateTopic(dev.id("power_demand_avg")), viper.GetBool("RETAIN_DEMAND"), formatDemand(int(math.Round(average))))
+}
+
+// Utilities bill demand charges on the highest average demand over a fixed
+// window (typically 15 minutes) within the billing period. With
+// DEMAND_CHARGE enabled the rolling window average is published along with
+// the period's peak of that average, which is persisted across restarts.
+type demandChargeTracker struct {
+	mu      sync.Mutex
+	samples []demandSample
+	started time.Time
+}
+
+var demandCharge demandChargeTracker
+
+func billingPeriodStart(now time.Time, day int) time.Time {
+	if day < 1 {
+		day = 1
+	} else if day > 28 {
+		day = 28
+	}
+	start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+func (d *demandChargeTracker) add(m Publisher, watts float64) {
+	if !viper.GetBool("DEMAND_CHARGE") {
+		return
+	}
+	window := viper.GetDuration("DEMAND_CHARGE_WINDOW")
+	now := clock.Now()
+
+	d.mu.Lock()
+	if d.started.IsZero() {
+		d.started = now
+	}
+	d.samples = append(d.samples, demandSample{t: now, watts: watts})
+	// Keep the newest sample at or before the window start so the average
+	// covers the whole window.
+	for len(d.samples) > 1 && !d.samples[1].t.After(now.Add(-window)) {
+		d.samples = d.samples[1:]
+	}
+	samples := append([]demandSample{}, d.samples...)
+	if samples[0].t.Before(now.Add(-window)) {
+		samples[0].t = now.Add(-window)
+	}
+	average := timeWeightedAverage(samples, now)
+	// Until a full window has been observed the average can overstate a
+	// short spike, so it does not count towards the peak.
+	full := now.Sub(d.started) >= window
+	d.mu.Unlock()
+
+	throttle.publish(m, stateTopic("meter_demand_window_avg"), viper.GetBool("RETAIN_DEMAND"), formatDemand(int(math.Round(average))))
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	changed := false
+	if period := billingPeriodStart(now.In(location), viper.GetInt("BILLING_DAY")); !persisted.BillingPeriodStart.Equal(period) {
+		log.Printf("Starting billing period %s, resetting demand peak", period.Format("2006-01-02"))
+		persisted.BillingPeriodStart = period
+		persisted.DemandPeakWatts = 0
+		persisted.DemandPeakTime = time.Time{}
+		changed = true
+	}
+	if full && average > persisted.DemandPeakWatts {
+		persisted.DemandPeakWatts = average
+		persisted.DemandPeakTime = now
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	saveState()
+
+	b, _ := json.Marshal(map[string]string{
+		"peak_time":            formatTimestamp(persisted.DemandPeakTime),
+		"billing_period_start": formatTimestamp(persisted.BillingPeriodStart),
+	})
+	m.Publish(attributesTopic("meter_demand_peak"), 0, true, b)
+	m.Publish(stateTopic("meter_demand_peak"), 0, true, formatDemand(int(math.Round(persisted.DemandPeakWatts))))
+}
+
+// intervalDemandTracker averages demand over clock-aligned intervals (e.g.
+// :00, :15, :30, :45) to match the interval data utilities bill on. Each
+// interval's average is published once the first reading after its end
+// arrives, labeled with the interval start.
+type intervalDemandTracker struct {
+	mu      sync.Mutex
+	start   time.Time
+	samples []demandSample
+}
+
+var intervalDemand intervalDemandTracker
+
+func (d *intervalDemandTracker) add(m Publisher, watts float64) {
+	if !viper.GetBool("INTERVAL_DEMAND") {
+		return
+	}
+	length := viper.GetDuration("INTERVAL_DEMAND_LENGTH")
+	now := clock.Now()
+	start := alignedStart(now, length)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.start.IsZero() {
+		// The first interval is partial, so it is never published.
+		d.start = start
+	} else if start.After(d.start) {
+		end := d.start.Add(length)
+		if len(d.samples) > 0 {
+			average := timeWeightedAverage(d.samples, end)
+			b, _ := json.Marshal(map[string]string{
+				"interval_start": formatTimestamp(d.start),
+				"interval_end":   formatTimestamp(end),
+			})
+			m.Publish(attributesTopic("meter_demand_interval"), 0, true, b)
+			m.Publish(stateTopic("meter_demand_interval"), 0, true, formatDemand(int(math.Round(average))))
+		}
+		// The last reading stays current into the new interval.
+		var carry []demandSample
+		if n := len(d.samples); n > 0 {
+			carry = []demandSample{{t: start, watts: d.samples[n-1].watts}}
+		}
+		d.start = start
+		d.samples = carry
+	}
+	d.samples = append(d.samples, demandSample{t: now, watts: watts})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDemandAggregatesUseDemandUnit(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	c := useFakeClock(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	demandCharge, intervalDemand = demandChargeTracker{}, intervalDemandTracker{}
+	viper.Set("DEDUP_FRAMES", false)
+	viper.Set("DEMAND_UNIT", "kW")
+	viper.Set("DEMAND_AVERAGE_SECONDS", 60)
+	viper.Set("DEMAND_CHARGE", true)
+	viper.Set("DEMAND_CHARGE_WINDOW", time.Minute)
+	viper.Set("INTERVAL_DEMAND", true)
+	viper.Set("INTERVAL_DEMAND_LENGTH", 15*time.Minute)
+
+	dispatchFrame(fc, []byte(demandFrame))
+	c.advance(15 * time.Minute)
+	dispatchFrame(fc, []byte(demandFrame))
+
+	for _, id := range []string{"meter_power_demand", "meter_power_demand_avg", "meter_demand_window_avg", "meter_demand_peak", "meter_demand_interval"} {
+		if got, _ := rec.last(stateTopic(id)); got != "1.234" {
+			t.Errorf("%s = %q, want 1.234", id, got)
+		}
+	}
+	for _, config := range discoveryRegistry() {
+		if config.DeviceClass == "power" && config.UnitOfMeasurement != "kW" {
+			t.Errorf("%s is in %q, want kW", config.UniqueID, config.UnitOfMeasurement)
+		}
+	}
+}
+
+func TestRollingDemandUnevenSamples(t *testing.T) {
+	_, rec := testFrameContext(t)
+	c := useFakeClock(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	viper.Set("DEMAND_AVERAGE_SECONDS", 60)
+	dev := primaryDevice()
+	topic := stateTopic(dev.id("power_demand_avg"))
+
+	for _, step := range []struct {
+		after time.Duration
+		watts float64
+		want  string
+	}{
+		{0, 1000, "1000"},
+		// 1000 W for 10s.
+		{10 * time.Second, 2000, "1000"},
+		// 1000 W for 10s, then 2000 W for 30s.
+		{30 * time.Second, 500, "1750"},
+		// The first two samples have left the window; 500 W held for it all.
+		{60 * time.Second, 3000, "500"},
+		// 500 W for the 30s left of its sample, then 3000 W for 30s.
+		{30 * time.Second, 0, "1750"},
+	} {
+		c.advance(step.after)
+		dev.average.add(rec, dev, step.watts)
+		if got, _ := rec.last(topic); got != step.want {
+			t.Errorf("after %v at %v W: average %q, want %q", c.Now().Format("15:04:05"), step.watts, got, step.want)
+		}
+	}
+	// The 500 W sample straddles the window start, so it stays.
+	if n := len(dev.average.samples); n != 3 {
+		t.Errorf("%d samples kept, want 3", n)
+	}
+}
+
+func TestTimeWeightedAverage(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration, watts float64) demandSample { return demandSample{start.Add(d), watts} }
+	for _, tc := range []struct {
+		samples []demandSample
+		now     time.Duration
+		want    float64
+	}{
+		{nil, 0, 0},
+		{[]demandSample{at(0, 800)}, 0, 800},
+		{[]demandSample{at(0, 800)}, time.Minute, 800},
+		{[]demandSample{at(0, 0), at(45*time.Second, 4000)}, time.Minute, 1000},
+		{[]demandSample{at(0, 100), at(time.Second, 200), at(3*time.Second, -300)}, 4 * time.Second, 50},
+	} {
+		if got := timeWeightedAverage(tc.samples, start.Add(tc.now)); got != tc.want {
+			t.Errorf("timeWeightedAverage(%v, +%v) = %v, want %v", tc.samples, tc.now, got, tc.want)
+		}
+	}
+}
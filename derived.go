@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Some meters only broadcast summation. With DERIVE_DEMAND enabled, demand is
+// approximated from the change in summation between consecutive frames
+// whenever no native InstantaneousDemand has arrived recently.
+type demandDeriver struct {
+	mu            sync.Mutex
+	lastNative    time.Time
+	prevDelivered float64
+	prevReceived  float64
+	prevTime      time.Time
+	source        string
+}
+
+var deriver demandDeriver
+
+func (d *demandDeriver) nativeSeen(m Publisher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastNative = clock.Now()
+	d.setSource(m, "meter")
+}
+
+func (d *demandDeriver) fromSummation(m Publisher, delivered, received float64, timestamp string) (watts int, ok bool) {
+	if !viper.GetBool("DERIVE_DEMAND") {
+		return 0, false
+	}
+	t, err := parseEmuTimestamp(timestamp)
+	if err != nil {
+		return 0, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prevTime, prevDelivered, prevReceived := d.prevTime, d.prevDelivered, d.prevReceived
+	d.prevTime, d.prevDelivered, d.prevReceived = t, delivered, received
+
+	if clock.Now().Sub(d.lastNative) < viper.GetDuration("DERIVE_DEMAND_AFTER") {
+		return 0, false
+	}
+	dt := t.Sub(prevTime)
+	if prevTime.IsZero() || dt <= 0 {
+		return 0, false
+	}
+
+	kwh := (delivered - prevDelivered) - (received - prevReceived)
+	watts = int(kwh / dt.Hours() * 1000)
+	slog.Debug("Derived demand from summation", "demand_watts", watts, "interval", dt)
+	d.setSource(m, "derived")
+	return watts, true
+}
+
+func (d *demandDeriver) setSource(m Publisher, source string) {
+	if !viper.GetBool("DERIVE_DEMAND") || d.source == source {
+		return
+	}
+	d.source = source
+	b, _ := json.Marshal(map[string]string{"source": source})
+	m.Publish(attributesTopic(primaryDevice().id("power_demand")), 0, true, b)
+}
+
+// With INTERVAL_ENERGY enabled, the energy delivered between consecutive
+// summation frames is published as its own sensor.
+type intervalTracker struct {
+	mu            sync.Mutex
+	prevDelivered float64
+	prevTime      time.Time
+	havePrev      bool
+}
+
+var intervals intervalTracker
+
+func (it *intervalTracker) update(m Publisher, delivered float64, timestamp string) {
+	if !viper.GetBool("INTERVAL_ENERGY") {
+		return
+	}
+	t, err := parseEmuTimestamp(timestamp)
+	if err != nil {
+		t = clock.Now().UTC()
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	prevDelivered, prevTime, havePrev := it.prevDelivered, it.prevTime, it.havePrev
+	it.prevDelivered, it.prevTime, it.havePrev = delivered, t, true
+	if !havePrev {
+		return
+	}
+
+	b, _ := json.Marshal(map[string]string{
+		"interval_start": formatTimestamp(prevTime),
+		"interval_end":   formatTimestamp(t),
+	})
+	m.Publish(attributesTopic("meter_interval_energy"), 0, false, b)
+	m.Publish(stateTopic("meter_interval_energy"), 0, false, formatEnergy(delivered-prevDelivered))
+}
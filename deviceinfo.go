@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// DeviceInfo is the EMU-2's reply to get_device_info. InstallCode and
+// LinkKey pair the dongle with the meter and are never published or logged.
+type DeviceInfo struct {
+	XMLName      xml.Name `xml:"DeviceInfo"`
+	DeviceMacId  string   `xml:"DeviceMacId"`
+	InstallCode  string   `xml:"InstallCode"`
+	LinkKey      string   `xml:"LinkKey"`
+	FWVersion    string   `xml:"FWVersion" validate:"required"`
+	HWVersion    string   `xml:"HWVersion"`
+	ImageType    string   `xml:"ImageType"`
+	Manufacturer string   `xml:"Manufacturer"`
+	ModelId      string   `xml:"ModelId"`
+	DateCode     string   `xml:"DateCode"`
+}
+
+// deviceDetails is what the Home Assistant device block shows for an EMU-2
+// once it has answered get_device_info.
+type deviceDetails struct {
+	model, swVersion, hwVersion string
+}
+
+func handleDeviceInfo(fc *frameContext, data []byte) {
+	var info DeviceInfo
+	if err := fc.decode(data, &info); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	details := deviceDetails{
+		model:     strings.TrimSpace(info.ModelId),
+		swVersion: strings.TrimSpace(info.FWVersion),
+		hwVersion: strings.TrimSpace(info.HWVersion),
+	}
+	b, _ := json.Marshal(map[string]string{
+		"hw_version":   details.hwVersion,
+		"model_id":     details.model,
+		"manufacturer": strings.TrimSpace(info.Manufacturer),
+		"image_type":   strings.TrimSpace(info.ImageType),
+		"date_code":    strings.TrimSpace(info.DateCode),
+	})
+	fc.m.Publish(attributesTopic(fc.dev.id("firmware")), 0, true, b)
+	fc.m.Publish(stateTopic(fc.dev.id("firmware")), 0, true, details.swVersion)
+
+	fc.dev.macMu.Lock()
+	changed := fc.dev.details != details
+	fc.dev.details = details
+	fc.dev.macMu.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("%s is a %s, firmware %s, hardware %s", fc.dev.Name, details.model, details.swVersion, details.hwVersion)
+	if !sparkplugEnabled() {
+		setupMQTTDiscovery(fc.m)
+	}
+}
+
+var pairingSecrets = regexp.MustCompile(`<(InstallCode|LinkKey)>[^<]*</(InstallCode|LinkKey)>`)
+
+// redactPairingSecrets blanks the install code and link key in a raw
+// DeviceInfo frame before it is written anywhere.
+func redactPairingSecrets(data []byte) []byte {
+	if !pairingSecrets.Match(data) {
+		return data
+	}
+	return pairingSecrets.ReplaceAll(data, []byte("<$1>REDACTED</$2>"))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// An emuDevice is one EMU-2 dongle. DEVICES lists several of them, each with
+// its own serial port and entity prefix; without it the single SERIAL_PORT
+// reports under the "meter" prefix. MeterMacID, when set, pins the meter
+// whose frames are accepted.
+type emuDevice struct {
+	Name       string `mapstructure:"name"`
+	SerialPort string `mapstructure:"serial_port"`
+	Prefix     string `mapstructure:"prefix"`
+	MeterMacID string `mapstructure:"meter_mac_id"`
+
+	state    *meterState
+	average  rollingDemand
+	combined combinedState
+
+	macMu     sync.Mutex
+	meterMAC  string
+	deviceMAC string
+	details   deviceDetails
+	foreign   map[string]bool // meter MACs already warned about
+	candidate string          // a new meter MAC not yet seen macChangeFrames times in a row
+	runLength int
+}
+
+// macChangeFrames is how many consecutive frames must carry a new meter MAC
+// before it replaces the learned one, so the odd frame relayed from a
+// neighbouring meter is not taken for a re-pairing.
+const macChangeFrames = 3
+
+var devices []*emuDevice
+
+// id builds a per-device entity ID, e.g. "meter_kitchen_power_demand".
+func (d *emuDevice) id(suffix string) string {
+	return d.Prefix + "_" + suffix
+}
+
+// The aggregates (cost, demand charge, derived demand, hourly and interval
+// energy), the price, Sparkplug and cloud sinks follow the first device only.
+func (d *emuDevice) primary() bool {
+	return d == devices[0]
+}
+
+func normalizeMAC(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.TrimPrefix(s, "0x")
+}
+
+// frameMACs returns the MAC addresses a frame carries, if any.
+func frameMACs(data []byte) (meter, device string) {
+	var frame struct {
+		DeviceMacId string
+		MeterMacId  string
+	}
+	if xml.Unmarshal(data, &frame) != nil {
+		return "", ""
+	}
+	return normalizeMAC(frame.MeterMacId), normalizeMAC(frame.DeviceMacId)
+}
+
+// acceptsMeter reports whether a frame with this meter MAC should be
+// handled: with a pinned MeterMacID, frames relayed from other meters in
+// range are not. Frames without a meter MAC are always accepted.
+func (d *emuDevice) acceptsMeter(meter string) bool {
+	return d.MeterMacID == "" || meter == "" || meter == normalizeMAC(d.MeterMacID)
+}
+
+// rejectMeter warns, once per MAC, that frames from a meter other than the
+// pinned one are being ignored: either another meter is in range or the
+// EMU-2 has been re-paired.
+func (d *emuDevice) rejectMeter(meter string) {
+	d.macMu.Lock()
+	warned := d.foreign[meter]
+	if d.foreign == nil {
+		d.foreign = map[string]bool{}
+	}
+	d.foreign[meter] = true
+	d.macMu.Unlock()
+	if !warned {
+		slog.Warn("Ignoring frames from a meter other than METER_MAC_ID; if the EMU-2 was re-paired, update METER_MAC_ID",
+			"device", d.Name, "meter_mac", meter, "meter_mac_id", normalizeMAC(d.MeterMacID))
+	}
+}
+
+// learnMAC records the MAC addresses carried by a frame. The first time they
+// are seen, or when they change because the EMU-2 was re-paired to another
+// meter, discovery is republished so the Home Assistant device is
+// identified by the real meter rather than a placeholder.
+func (d *emuDevice) learnMAC(m Publisher, meter, device string) {
+	if meter == "" {
+		return
+	}
+	d.macMu.Lock()
+	previous := d.meterMAC
+	changed := previous == ""
+	if previous != "" && previous != meter {
+		if d.candidate != meter {
+			d.candidate, d.runLength = meter, 0
+		}
+		d.runLength++
+		changed = d.runLength >= macChangeFrames
+	} else {
+		d.candidate = ""
+	}
+	if changed {
+		d.meterMAC, d.deviceMAC, d.candidate = meter, device, ""
+	}
+	d.macMu.Unlock()
+	if !changed {
+		return
+	}
+	if previous == "" {
+		log.Printf("Learned meter MAC %s for %s; set METER_MAC_ID to ignore other meters", meter, d.Name)
+	} else {
+		slog.Warn("Meter MAC changed; the EMU-2 appears to have been re-paired, republishing discovery",
+			"device", d.Name, "old_meter_mac", previous, "meter_mac", meter)
+	}
+	if !sparkplugEnabled() {
+		setupMQTTDiscovery(m)
+	}
+}
+
+// identifier is the Home Assistant device identifier: the meter MAC once
+// known, otherwise a name-based placeholder.
+func (d *emuDevice) identifier() string {
+	d.macMu.Lock()
+	defer d.macMu.Unlock()
+	if d.meterMAC != "" {
+		return "emu2_" + d.meterMAC
+	}
+	if d.primary() {
+		return "emu2mqtt"
+	}
+	return "emu2mqtt_" + d.Prefix
+}
+
+func primaryDevice() *emuDevice {
+	return devices[0]
+}
+
+func loadDevices() error {
+	if !viper.IsSet("DEVICES") {
+		devices = []*emuDevice{{Name: "Meter", SerialPort: viper.GetString("SERIAL_PORT"), Prefix: defaultMeter, MeterMacID: viper.GetString("METER_MAC_ID"), state: &state}}
+		return nil
+	}
+	var configured []*emuDevice
+	if err := viper.UnmarshalKey("DEVICES", &configured); err != nil {
+		return fmt.Errorf("invalid DEVICES: %w", err)
+	}
+	if len(configured) == 0 {
+		return fmt.Errorf("DEVICES is empty")
+	}
+	prefixes := map[string]bool{}
+	for i, d := range configured {
+		if d.SerialPort == "" {
+			return fmt.Errorf("DEVICES entry %d has no serial_port", i)
+		}
+		if d.Name == "" {
+			d.Name = fmt.Sprintf("Meter %d", i+1)
+		}
+		if d.Prefix == "" {
+			d.Prefix = defaultMeter + "_" + strings.ReplaceAll(strings.ToLower(d.Name), " ", "_")
+		}
+		if prefixes[d.Prefix] {
+			return fmt.Errorf("DEVICES prefix %q is used twice", d.Prefix)
+		}
+		prefixes[d.Prefix] = true
+		d.state = &meterState{}
+	}
+	configured[0].state = &state
+	devices = configured
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// captureWarnings sends slog warnings to the returned buffer for the rest of
+// the test.
+func captureWarnings(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous, out, flags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+// meterFrame is demandFrame as relayed from the meter with the given MAC.
+func meterFrame(mac string) []byte {
+	return []byte(strings.Replace(demandFrame, "0x00135003000abcde", mac, 1))
+}
+
+func TestMeterMACChangeWarnsOnce(t *testing.T) {
+	const first, second = "0x00135003000abcde", "0x0013500300012345"
+	fc, _ := testFrameContext(t)
+	viper.Set("DEDUP_FRAMES", false)
+	warnings := captureWarnings(t)
+
+	for i := 0; i < 3; i++ {
+		dispatchFrame(fc, meterFrame(first))
+	}
+	for i := 0; i < 2*macChangeFrames; i++ {
+		dispatchFrame(fc, meterFrame(second))
+	}
+	if n := strings.Count(warnings.String(), "Meter MAC changed"); n != 1 {
+		t.Errorf("re-pairing warned %d times, want once:\n%s", n, warnings)
+	}
+	if got := fc.dev.meterMAC; got != normalizeMAC(second) {
+		t.Errorf("meter MAC is %s after re-pairing, want %s", got, normalizeMAC(second))
+	}
+}
+
+func TestPinnedMeterMACWarnsOncePerMeter(t *testing.T) {
+	resetBridge(t)
+	viper.Set("DEDUP_FRAMES", false)
+	viper.Set("METER_MAC_ID", "0x00135003000abcde")
+	if err := loadDevices(); err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingPublisher{}
+	fc := &frameContext{m: rec, dev: primaryDevice()}
+	warnings := captureWarnings(t)
+
+	for i := 0; i < 3; i++ {
+		dispatchFrame(fc, meterFrame("0x0013500300012345"))
+		dispatchFrame(fc, meterFrame("0x00135003000abcde"))
+	}
+	if n := strings.Count(warnings.String(), "Ignoring frames from a meter other than METER_MAC_ID"); n != 1 {
+		t.Errorf("foreign meter warned %d times, want once:\n%s", n, warnings)
+	}
+	if got := len(rec.states()); got != 3 {
+		t.Errorf("published %d states, want 3 from the pinned meter", got)
+	}
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type DiscoveryConfig struct {
+	Platform          string                  `json:"platform,omitempty"`
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	DeviceClass       string                  `json:"device_class,omitempty"`
+	StateTopic        string                  `json:"state_topic"`
+	ValueTemplate     string                  `json:"value_template,omitempty"`
+	StateClass        string                  `json:"state_class,omitempty"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement,omitempty"`
+	AttributesTopic   string                  `json:"json_attributes_topic,omitempty"`
+	EntityPicture     string                  `json:"entity_picture,omitempty"`
+	Availability      []DiscoveryAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string                  `json:"availability_mode,omitempty"`
+	EntityCategory    string                  `json:"entity_category,omitempty"`
+	Device            *DiscoveryDevice        `json:"device,omitempty"`
+}
+
+type DiscoveryAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
+}
+
+type DiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+	HWVersion    string   `json:"hw_version,omitempty"`
+}
+
+type DiscoveryOrigin struct {
+	Name string `json:"name"`
+}
+
+type DeviceDiscoveryConfig struct {
+	Device     DiscoveryDevice            `json:"device"`
+	Origin     DiscoveryOrigin            `json:"origin"`
+	Components map[string]DiscoveryConfig `json:"components"`
+}
+
+// discoveryPrefix is where Home Assistant listens for config topics.
+func discoveryPrefix() string {
+	return strings.TrimSuffix(viper.GetString("DISCOVERY_PREFIX"), "/")
+}
+
+// topicPrefix is the base of the state, attribute and availability topics.
+// It follows DISCOVERY_PREFIX unless TOPIC_PREFIX is set.
+func topicPrefix() string {
+	if p := viper.GetString("TOPIC_PREFIX"); p != "" {
+		return strings.TrimSuffix(p, "/")
+	}
+	return discoveryPrefix()
+}
+
+func stateTopic(id string) string {
+	return topicPrefix() + "/sensor/" + id + "/state"
+}
+
+func attributesTopic(id string) string {
+	return topicPrefix() + "/sensor/" + id + "/attributes"
+}
+
+// deviceDiscovery returns the readings every EMU-2 reports, under its prefix.
+func deviceDiscovery(dev *emuDevice) []DiscoveryConfig {
+	configs := []DiscoveryConfig{
+		{
+			Platform:          "sensor",
+			Name:              dev.Name + " Power Demand",
+			UniqueID:          dev.id("power_demand"),
+			DeviceClass:       "power",
+			StateTopic:        stateTopic(dev.id("power_demand")),
+			StateClass:        "measurement",
+			UnitOfMeasurement: demandUnit(),
+		},
+		{
+			Platform:          "sensor",
+			Name:              dev.Name + " Total Energy Delivered",
+			UniqueID:          dev.id("total_energy_delivered"),
+			DeviceClass:       "energy",
+			StateTopic:        stateTopic(dev.id("total_energy_delivered")),
+			StateClass:        "total_increasing",
+			UnitOfMeasurement: energyUnit(),
+			AttributesTopic:   attributesTopic(dev.id("total_energy_delivered")),
+		},
+		{
+			Platform:          "sensor",
+			Name:              dev.Name + " Total Energy Received",
+			UniqueID:          dev.id("total_energy_received"),
+			DeviceClass:       "energy",
+			StateTopic:        stateTopic(dev.id("total_energy_received")),
+			StateClass:        "total_increasing",
+			UnitOfMeasurement: energyUnit(),
+			AttributesTopic:   attributesTopic(dev.id("total_energy_received")),
+		},
+		{
+			// Net energy falls while exporting, so it is a total rather
+			// than total_increasing.
+			Platform:          "sensor",
+			Name:              dev.Name + " Net Energy",
+			UniqueID:          dev.id("net_energy"),
+			DeviceClass:       "energy",
+			StateTopic:        stateTopic(dev.id("net_energy")),
+			StateClass:        "total",
+			UnitOfMeasurement: energyUnit(),
+		},
+	}
+	if jsonPublishMode() {
+		for i, field := range []string{"demand", "delivered", "received", "net"} {
+			configs[i].StateTopic = combinedStateTopic(dev)
+			configs[i].ValueTemplate = "{{ value_json." + field + " }}"
+		}
+	}
+	configs = append(configs, DiscoveryConfig{
+		Platform:          "sensor",
+		Name:              dev.Name + " Current Period Usage",
+		UniqueID:          dev.id("current_period_usage"),
+		DeviceClass:       "energy",
+		StateTopic:        stateTopic(dev.id("current_period_usage")),
+		StateClass:        "total",
+		UnitOfMeasurement: energyUnit(),
+		AttributesTopic:   attributesTopic(dev.id("current_period_usage")),
+	}, DiscoveryConfig{
+		Platform:          "sensor",
+		Name:              dev.Name + " Last Period Usage",
+		UniqueID:          dev.id("last_period_usage"),
+		DeviceClass:       "energy",
+		StateTopic:        stateTopic(dev.id("last_period_usage")),
+		UnitOfMeasurement: energyUnit(),
+		AttributesTopic:   attributesTopic(dev.id("last_period_usage")),
+	}, DiscoveryConfig{
+		Platform:        "sensor",
+		Name:            dev.Name + " Firmware",
+		UniqueID:        dev.id("firmware"),
+		StateTopic:      stateTopic(dev.id("firmware")),
+		AttributesTopic: attributesTopic(dev.id("firmware")),
+		EntityCategory:  "diagnostic",
+	})
+	if viper.GetInt("DEMAND_AVERAGE_SECONDS") > 0 {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              dev.Name + " Power Demand Average",
+			UniqueID:          dev.id("power_demand_avg"),
+			DeviceClass:       "power",
+			StateTopic:        stateTopic(dev.id("power_demand_avg")),
+			StateClass:        "measurement",
+			UnitOfMeasurement: demandUnit(),
+		})
+	}
+	return configs
+}
+
+// deviceOf returns the device an entity belongs to; entities outside any
+// device's prefix follow the first device.
+func deviceOf(id string) *emuDevice {
+	for _, dev := range devices[1:] {
+		if strings.HasPrefix(id, dev.Prefix+"_") {
+			return dev
+		}
+	}
+	return primaryDevice()
+}
+
+// Every entity the bridge exposes to Home Assistant. Both discovery modes
+// are generated from this list.
+func discoveryRegistry() []DiscoveryConfig {
+	configs := deviceDiscovery(primaryDevice())
+	configs = append(configs, []DiscoveryConfig{
+		{
+			// A price per kWh has no device_class: Home Assistant's
+			// monetary class only takes a bare currency as its unit.
+			Platform:          "sensor",
+			Name:              "Meter Price",
+			UniqueID:          "meter_price",
+			StateTopic:        stateTopic("meter_price"),
+			UnitOfMeasurement: currency() + "/kWh",
+			AttributesTopic:   attributesTopic("meter_price"),
+		},
+		{
+			Platform:        "sensor",
+			Name:            "Meter Price Block",
+			UniqueID:        "meter_price_block",
+			StateTopic:      stateTopic("meter_price_block"),
+			AttributesTopic: attributesTopic("meter_price_block"),
+		},
+		{
+			Platform:          "sensor",
+			Name:              "Meter Block Price",
+			UniqueID:          "meter_block_price",
+			StateTopic:        stateTopic("meter_block_price"),
+			UnitOfMeasurement: currency() + "/kWh",
+		},
+		{
+			Platform:          "sensor",
+			Name:              "Meter Cost Rate",
+			UniqueID:          "meter_cost_rate",
+			StateTopic:        stateTopic("meter_cost_rate"),
+			UnitOfMeasurement: currency() + "/h",
+		},
+		{
+			Platform:       "sensor",
+			Name:           "Meter Link Connected Since",
+			UniqueID:       "meter_link_uptime",
+			DeviceClass:    "timestamp",
+			StateTopic:     stateTopic("meter_link_uptime"),
+			EntityCategory: "diagnostic",
+		},
+		{
+			Platform:        "sensor",
+			Name:            "Meter Message",
+			UniqueID:        "meter_message",
+			StateTopic:      stateTopic("meter_message"),
+			AttributesTopic: attributesTopic("meter_message"),
+		},
+		{
+			Platform:    "binary_sensor",
+			Name:        "Meter Link",
+			UniqueID:    "meter_link",
+			DeviceClass: "connectivity",
+			StateTopic:  meterLinkTopic(),
+		},
+		{
+			Platform:       "sensor",
+			Name:           "Meter Link Strength",
+			UniqueID:       "meter_link_strength",
+			StateTopic:     stateTopic("meter_link_strength"),
+			StateClass:     "measurement",
+			EntityCategory: "diagnostic",
+		},
+		{
+			Platform:        "sensor",
+			Name:            "Meter Link Status",
+			UniqueID:        "meter_link_status",
+			StateTopic:      stateTopic("meter_link_status"),
+			AttributesTopic: attributesTopic("meter_link_status"),
+			EntityCategory:  "diagnostic",
+		},
+		{
+			Platform:        "sensor",
+			Name:            "Meter Schedule",
+			UniqueID:        "meter_schedule",
+			StateTopic:      stateTopic("meter_schedule"),
+			AttributesTopic: attributesTopic("meter_schedule"),
+			EntityCategory:  "diagnostic",
+		},
+		{
+			Platform:        "sensor",
+			Name:            "Meter Clock",
+			UniqueID:        "meter_clock",
+			DeviceClass:     "timestamp",
+			StateTopic:      stateTopic("meter_clock"),
+			AttributesTopic: attributesTopic("meter_clock"),
+			EntityCategory:  "diagnostic",
+		},
+		{
+			Platform:          "sensor",
+			Name:              "Meter Clock Drift",
+			UniqueID:          "meter_clock_drift",
+			DeviceClass:       "duration",
+			StateTopic:        stateTopic("meter_clock_drift"),
+			StateClass:        "measurement",
+			UnitOfMeasurement: "s",
+			EntityCategory:    "diagnostic",
+		},
+		{
+			Platform:       "sensor",
+			Name:           "Meter Link Channel",
+			UniqueID:       "meter_link_channel",
+			StateTopic:     stateTopic("meter_link_channel"),
+			EntityCategory: "diagnostic",
+		},
+	}...)
+	if viper.GetDuration("FRAME_COUNTS_INTERVAL") > 0 {
+		for _, counter := range []struct{ id, name string }{
+			{"emu2mqtt_frames_demand", "Demand Frames"},
+			{"emu2mqtt_frames_summation", "Summation Frames"},
+			{"emu2mqtt_frames_time", "Time Frames"},
+			{"emu2mqtt_frames_invalid", "Invalid Frames"},
+		} {
+			configs = append(configs, DiscoveryConfig{
+				Platform:       "sensor",
+				Name:           counter.name,
+				UniqueID:       counter.id,
+				StateTopic:     stateTopic(counter.id),
+				StateClass:     "total_increasing",
+				EntityCategory: "diagnostic",
+			})
+		}
+	}
+	if viper.GetBool("DEDUP_FRAMES") {
+		configs = append(configs, DiscoveryConfig{
+			Platform:       "sensor",
+			Name:           "Duplicate Frames Dropped",
+			UniqueID:       "emu2mqtt_duplicates_dropped",
+			StateTopic:     stateTopic("emu2mqtt_duplicates_dropped"),
+			StateClass:     "total_increasing",
+			EntityCategory: "diagnostic",
+		})
+	}
+	if costTrackingEnabled() {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Total Cost",
+			UniqueID:          "meter_cost_total",
+			DeviceClass:       "monetary",
+			StateTopic:        stateTopic("meter_cost_total"),
+			StateClass:        "total",
+			UnitOfMeasurement: currency(),
+		})
+	}
+	if viper.GetBool("DEMAND_CHARGE") {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Demand Window Average",
+			UniqueID:          "meter_demand_window_avg",
+			DeviceClass:       "power",
+			StateTopic:        stateTopic("meter_demand_window_avg"),
+			StateClass:        "measurement",
+			UnitOfMeasurement: demandUnit(),
+		}, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Billing Period Peak Demand",
+			UniqueID:          "meter_demand_peak",
+			DeviceClass:       "power",
+			StateTopic:        stateTopic("meter_demand_peak"),
+			StateClass:        "measurement",
+			UnitOfMeasurement: demandUnit(),
+			AttributesTopic:   attributesTopic("meter_demand_peak"),
+		})
+	}
+	if viper.GetBool("INTERVAL_DEMAND") {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Interval Demand",
+			UniqueID:          "meter_demand_interval",
+			DeviceClass:       "power",
+			StateTopic:        stateTopic("meter_demand_interval"),
+			StateClass:        "measurement",
+			UnitOfMeasurement: demandUnit(),
+			AttributesTopic:   attributesTopic("meter_demand_interval"),
+		})
+	}
+	if viper.GetBool("HOURLY_ENERGY") {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Energy This Hour",
+			UniqueID:          "meter_energy_hourly",
+			DeviceClass:       "energy",
+			StateTopic:        stateTopic("meter_energy_hourly"),
+			UnitOfMeasurement: energyUnit(),
+			AttributesTopic:   attributesTopic("meter_energy_hourly"),
+		})
+	}
+	if viper.GetBool("DAILY_ENERGY") {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Energy Delivered Today",
+			UniqueID:          "meter_energy_delivered_today",
+			DeviceClass:       "energy",
+			StateTopic:        stateTopic("meter_energy_delivered_today"),
+			StateClass:        "total_increasing",
+			UnitOfMeasurement: energyUnit(),
+			AttributesTopic:   attributesTopic("meter_energy_delivered_today"),
+		})
+	}
+	if viper.GetBool("INTERVAL_ENERGY") {
+		configs = append(configs, DiscoveryConfig{
+			Platform:          "sensor",
+			Name:              "Meter Interval Energy",
+			UniqueID:          "meter_interval_energy",
+			DeviceClass:       "energy",
+			StateTopic:        stateTopic("meter_interval_energy"),
+			UnitOfMeasurement: energyUnit(),
+			AttributesTopic:   attributesTopic("meter_interval_energy"),
+		})
+	}
+	for _, dev := range devices[1:] {
+		configs = append(configs, deviceDiscovery(dev)...)
+	}
+	pictures := viper.GetStringMapString("ENTITY_PICTURES")
+	for i := range configs {
+		if configs[i].UniqueID == primaryDevice().id("power_demand") && viper.GetBool("DERIVE_DEMAND") {
+			configs[i].AttributesTopic = attributesTopic(configs[i].UniqueID)
+		}
+		configs[i].Availability = append(configs[i].Availability, DiscoveryAvailability{
+			Topic:               bridgeAvailabilityTopic(),
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+		})
+		if meterAvailabilityEnabled() {
+			configs[i].Availability = append(configs[i].Availability, DiscoveryAvailability{Topic: meterAvailabilityTopic(deviceOf(configs[i].UniqueID).Prefix)})
+		}
+		if len(configs[i].Availability) > 1 {
+			configs[i].AvailabilityMode = viper.GetString("AVAILABILITY_MODE")
+		}
+		// viper lower-cases map keys read from the config file.
+		configs[i].EntityPicture = pictures[strings.ToLower(configs[i].UniqueID)]
+	}
+	return configs
+}
+
+func validateDiscoverySettings() error {
+	switch mode := viper.GetString("DISCOVERY_MODE"); mode {
+	case "component", "device":
+	default:
+		return fmt.Errorf("invalid DISCOVERY_MODE %q, expected \"component\" or \"device\"", mode)
+	}
+	switch mode := viper.GetString("AVAILABILITY_MODE"); mode {
+	case "all", "any", "latest":
+	default:
+		return fmt.Errorf("invalid AVAILABILITY_MODE %q, expected \"all\", \"any\" or \"latest\"", mode)
+	}
+	return nil
+}
+
+func discoveryDevice(dev *emuDevice) DiscoveryDevice {
+	name := "EMU-2"
+	if len(devices) > 1 {
+		name += " " + dev.Name
+	}
+	dev.macMu.Lock()
+	details := dev.details
+	dev.macMu.Unlock()
+	model := "EMU-2"
+	if details.model != "" {
+		model = details.model
+	}
+	return DiscoveryDevice{
+		Identifiers:  []string{dev.identifier()},
+		Name:         name,
+		Manufacturer: "Rainforest Automation",
+		Model:        model,
+		SWVersion:    details.swVersion,
+		HWVersion:    details.hwVersion,
+	}
+}
+
+var (
+	discoveryUnits = map[string][]string{
+		"power":  {"W", "kW"},
+		"energy": {"Wh", "kWh", "MWh"},
+	}
+	discoveryStateClasses = map[string][]string{
+		"power":    {"measurement"},
+		"energy":   {"total", "total_increasing", ""},
+		"monetary": {"total", ""},
+	}
+	// Home Assistant's monetary sensors take a bare ISO 4217 currency as
+	// their unit, never a rate such as USD/kWh.
+	monetaryUnit = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDiscovery checks a config carries what Home Assistant needs to
+// create the entity, so a bad entry fails loudly here rather than silently
+// never appearing in HA.
+func validateDiscovery(cfg DiscoveryConfig) error {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cfg.UniqueID, err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return fmt.Errorf("%s: payload is not valid JSON: %v", cfg.UniqueID, err)
+	}
+	for _, key := range []string{"name", "unique_id", "state_topic"} {
+		if v, _ := payload[key].(string); v == "" {
+			return fmt.Errorf("%s: missing required key %q", cfg.UniqueID, key)
+		}
+	}
+	if cfg.Platform == "" {
+		return fmt.Errorf("%s: missing platform", cfg.UniqueID)
+	}
+	if units, ok := discoveryUnits[cfg.DeviceClass]; ok && !contains(units, cfg.UnitOfMeasurement) {
+		return fmt.Errorf("%s: unit %q is not valid for device_class %s", cfg.UniqueID, cfg.UnitOfMeasurement, cfg.DeviceClass)
+	}
+	if cfg.DeviceClass == "monetary" && !monetaryUnit.MatchString(cfg.UnitOfMeasurement) {
+		return fmt.Errorf("%s: unit %q is not an ISO 4217 currency, as device_class monetary needs", cfg.UniqueID, cfg.UnitOfMeasurement)
+	}
+	if classes, ok := discoveryStateClasses[cfg.DeviceClass]; ok && !contains(classes, cfg.StateClass) {
+		return fmt.Errorf("%s: state_class %q is not valid for device_class %s", cfg.UniqueID, cfg.StateClass, cfg.DeviceClass)
+	}
+	for _, a := range cfg.Availability {
+		if a.Topic == "" {
+			return fmt.Errorf("%s: availability entry without a topic", cfg.UniqueID)
+		}
+	}
+	if cfg.AvailabilityMode != "" && !contains([]string{"all", "any", "latest"}, cfg.AvailabilityMode) {
+		return fmt.Errorf("%s: invalid availability_mode %q", cfg.UniqueID, cfg.AvailabilityMode)
+	}
+	return nil
+}
+
+func validateDiscoveryRegistry() error {
+	for _, c := range discoveryRegistry() {
+		if err := validateDiscovery(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishDiscovery(m Publisher, topic string, payload interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Print("Failed encoding discovery config for ", topic, ": ", err)
+		return
+	}
+	m.Publish(topic, max(1, stateQoS()), true, b)
+}
+
+// An entityOverride renames an entity in ENTITY_OVERRIDES, which is keyed by
+// the default unique_id, e.g. meter_power_demand: {name: Mains Power}. Only
+// the Home Assistant side changes; state topics keep the default ID.
+type entityOverride struct {
+	Name     string `mapstructure:"name"`
+	UniqueID string `mapstructure:"unique_id"`
+}
+
+func entityOverrides() map[string]entityOverride {
+	var overrides map[string]entityOverride
+	if err := viper.UnmarshalKey("ENTITY_OVERRIDES", &overrides); err != nil {
+		log.Print("Ignoring invalid ENTITY_OVERRIDES: ", err)
+	}
+	return overrides
+}
+
+func (o entityOverride) apply(c *DiscoveryConfig) {
+	if o.Name != "" {
+		c.Name = o.Name
+	}
+	if o.UniqueID != "" {
+		c.UniqueID = o.UniqueID
+	}
+}
+
+func setupMQTTDiscovery(m Publisher) {
+	if !viper.GetBool("HA_DISCOVERY") {
+		if viper.GetBool("HA_DISCOVERY_CLEANUP") {
+			clearMQTTDiscovery(m)
+		}
+		return
+	}
+	// viper lower-cases map keys read from the config file.
+	overrides := entityOverrides()
+	switch viper.GetString("DISCOVERY_MODE") {
+	case "device":
+		cfg := DeviceDiscoveryConfig{
+			Device:     discoveryDevice(primaryDevice()),
+			Origin:     DiscoveryOrigin{Name: "emu2mqtt"},
+			Components: map[string]DiscoveryConfig{},
+		}
+		for _, c := range discoveryRegistry() {
+			if err := validateDiscovery(c); err != nil {
+				log.Print("Skipping invalid discovery config: ", err)
+				continue
+			}
+			overrides[strings.ToLower(c.UniqueID)].apply(&c)
+			cfg.Components[c.UniqueID] = c
+		}
+		publishDiscovery(m, discoveryPrefix()+"/device/emu2mqtt/config", cfg)
+	default:
+		for _, c := range discoveryRegistry() {
+			if err := validateDiscovery(c); err != nil {
+				log.Print("Skipping invalid discovery config: ", err)
+				continue
+			}
+			device := discoveryDevice(deviceOf(c.UniqueID))
+			defaultTopic := componentDiscoveryTopic(c)
+			overrides[strings.ToLower(c.UniqueID)].apply(&c)
+			topic := componentDiscoveryTopic(c)
+			if topic != defaultTopic {
+				// A unique_id override moves the config; clear the one
+				// retained under the default ID, or Home Assistant keeps
+				// it as a second, orphaned entity.
+				m.Publish(defaultTopic, 1, true, "")
+			}
+			c.Platform = ""
+			c.Device = &device
+			publishDiscovery(m, topic, c)
+		}
+	}
+}
+
+func componentDiscoveryTopic(c DiscoveryConfig) string {
+	return discoveryPrefix() + "/" + c.Platform + "/" + c.UniqueID + "/config"
+}
+
+// clearMQTTDiscovery publishes empty retained payloads over every discovery
+// topic either mode would use, so Home Assistant removes the entities once
+// discovery has been turned off.
+func clearMQTTDiscovery(m Publisher) {
+	overrides := entityOverrides()
+	m.Publish(discoveryPrefix()+"/device/emu2mqtt/config", 1, true, "")
+	for _, c := range discoveryRegistry() {
+		defaultTopic := componentDiscoveryTopic(c)
+		overrides[strings.ToLower(c.UniqueID)].apply(&c)
+		if topic := componentDiscoveryTopic(c); topic != defaultTopic {
+			m.Publish(topic, 1, true, "")
+		}
+		m.Publish(defaultTopic, 1, true, "")
+	}
+}
+
+// Discovery configs are retained, so republishing them on every reconnect of
+// a flapping broker only adds load. Each connect that follows the previous
+// one within DISCOVERY_BACKOFF_RESET doubles the minimum spacing between
+// republishes, up to DISCOVERY_BACKOFF_MAX; a stable connection resets it.
+type discoveryBackoff struct {
+	mu          sync.Mutex
+	lastConnect time.Time
+	lastPublish time.Time
+	interval    time.Duration
+	pending     Timer
+}
+
+var discoveryThrottle discoveryBackoff
+
+func (b *discoveryBackoff) onConnect(m Publisher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := clock.Now()
+	if b.lastConnect.IsZero() || now.Sub(b.lastConnect) > viper.GetDuration("DISCOVERY_BACKOFF_RESET") {
+		b.interval = viper.GetDuration("DISCOVERY_BACKOFF_MIN")
+	} else {
+		b.interval *= 2
+		if maxInterval := viper.GetDuration("DISCOVERY_BACKOFF_MAX"); b.interval > maxInterval {
+			b.interval = maxInterval
+		}
+	}
+	b.lastConnect = now
+
+	if b.pending != nil {
+		return
+	}
+	wait := b.lastPublish.Add(b.interval).Sub(now)
+	if b.lastPublish.IsZero() || wait <= 0 {
+		b.lastPublish = now
+		setupMQTTDiscovery(m)
+		return
+	}
+
+	log.Printf("Reconnected to MQTT, delaying discovery republish by %v", wait.Round(time.Second))
+	b.pending = clock.AfterFunc(wait, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.pending = nil
+		b.lastPublish = clock.Now()
+		setupMQTTDiscovery(m)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestTopicPrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		discoveryPrefix, topicPrefix string
+		state, config                string
+	}{
+		{"", "",
+			"homeassistant/sensor/meter_power_demand/state",
+			"homeassistant/sensor/meter_power_demand/config"},
+		{"ha/", "",
+			"ha/sensor/meter_power_demand/state",
+			"ha/sensor/meter_power_demand/config"},
+		{"ha", "home/energy/",
+			"home/energy/sensor/meter_power_demand/state",
+			"ha/sensor/meter_power_demand/config"},
+		{"", "home/energy",
+			"home/energy/sensor/meter_power_demand/state",
+			"homeassistant/sensor/meter_power_demand/config"},
+	} {
+		_, rec := testFrameContext(t)
+		if tc.discoveryPrefix != "" {
+			viper.Set("DISCOVERY_PREFIX", tc.discoveryPrefix)
+		}
+		viper.Set("TOPIC_PREFIX", tc.topicPrefix)
+		viper.Set("HA_DISCOVERY", true)
+
+		if got := stateTopic("meter_power_demand"); got != tc.state {
+			t.Errorf("%q, %q: state topic %q, want %q", tc.discoveryPrefix, tc.topicPrefix, got, tc.state)
+		}
+		setupMQTTDiscovery(rec)
+		payload, ok := rec.last(tc.config)
+		if !ok {
+			t.Errorf("%q, %q: no discovery config on %s", tc.discoveryPrefix, tc.topicPrefix, tc.config)
+			continue
+		}
+		var config DiscoveryConfig
+		if err := json.Unmarshal([]byte(payload), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config.StateTopic != tc.state {
+			t.Errorf("%q, %q: config points at %q, want %q", tc.discoveryPrefix, tc.topicPrefix, config.StateTopic, tc.state)
+		}
+	}
+}
+
+func TestDiscoveryDisabled(t *testing.T) {
+	for _, cleanup := range []bool{false, true} {
+		fc, rec := testFrameContext(t)
+		viper.Set("HA_DISCOVERY", false)
+		viper.Set("HA_DISCOVERY_CLEANUP", cleanup)
+		viper.Set("DEMAND_CHARGE", true)
+
+		setupMQTTDiscovery(rec)
+		discoveryThrottle.onConnect(rec)
+		for _, frame := range []string{deviceInfoFrame, demandFrame, summationFrame, timeFrame} {
+			dispatchFrame(fc, []byte(frame))
+		}
+
+		var cleared int
+		for _, msg := range rec.msgs {
+			if !strings.HasSuffix(msg.topic, "/config") {
+				continue
+			}
+			if !cleanup || msg.payload != "" || !msg.retained {
+				t.Errorf("cleanup %t: published %q to discovery topic %s", cleanup, msg.payload, msg.topic)
+			}
+			cleared++
+		}
+		if cleanup && cleared == 0 {
+			t.Error("HA_DISCOVERY_CLEANUP cleared no discovery topics")
+		}
+		if _, ok := rec.last(stateTopic("meter_power_demand")); !ok {
+			t.Errorf("cleanup %t: state not published with discovery off", cleanup)
+		}
+	}
+}
+
+func TestValidateDiscoveryRegistry(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"defaults", nil},
+		{"demand charge", map[string]interface{}{"DEMAND_CHARGE": true}},
+		{"interval demand", map[string]interface{}{"INTERVAL_DEMAND": true}},
+		{"hourly energy", map[string]interface{}{"HOURLY_ENERGY": true}},
+		{"daily energy", map[string]interface{}{"DAILY_ENERGY": true}},
+		{"interval energy", map[string]interface{}{"INTERVAL_ENERGY": true}},
+		{"dedup frames", map[string]interface{}{"DEDUP_FRAMES": true}},
+		{"flat rate", map[string]interface{}{"FLAT_RATE": 0.15}},
+		{"demand in kW", map[string]interface{}{"DEMAND_UNIT": "kW"}},
+		{"energy in Wh", map[string]interface{}{"ENERGY_UNIT": "Wh"}},
+		{"json publish mode", map[string]interface{}{"PUBLISH_MODE": "json"}},
+		{"two devices", map[string]interface{}{"DEVICES": []map[string]interface{}{
+			{"name": "House", "serial_port": "/dev/ttyACM0", "prefix": "meter"},
+			{"name": "Kitchen", "serial_port": "/dev/ttyACM1"},
+		}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resetBridge(t)
+			for key, value := range tc.config {
+				viper.Set(key, value)
+			}
+			if err := loadDevices(); err != nil {
+				t.Fatal(err)
+			}
+			if err := validateDiscoveryRegistry(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestValidateDiscoveryRejects(t *testing.T) {
+	valid := DiscoveryConfig{
+		Platform:          "sensor",
+		Name:              "Meter Power Demand",
+		UniqueID:          "meter_power_demand",
+		DeviceClass:       "power",
+		StateTopic:        "homeassistant/sensor/meter_power_demand/state",
+		StateClass:        "measurement",
+		UnitOfMeasurement: "W",
+	}
+	if err := validateDiscovery(valid); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		mutate func(*DiscoveryConfig)
+	}{
+		{"missing state_topic", func(c *DiscoveryConfig) { c.StateTopic = "" }},
+		{"power in kWh", func(c *DiscoveryConfig) { c.UnitOfMeasurement = "kWh" }},
+		{"energy measured", func(c *DiscoveryConfig) {
+			c.DeviceClass, c.UnitOfMeasurement, c.StateClass = "energy", "kWh", "measurement"
+		}},
+		{"bad availability_mode", func(c *DiscoveryConfig) { c.AvailabilityMode = "most" }},
+		{"monetary rate", func(c *DiscoveryConfig) {
+			c.DeviceClass, c.UnitOfMeasurement, c.StateClass = "monetary", "USD/kWh", "total"
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := valid
+			tc.mutate(&c)
+			if err := validateDiscovery(c); err == nil {
+				t.Error("invalid config accepted")
+			}
+		})
+	}
+}
+
+func TestUniqueIDOverrideClearsDefaultTopic(t *testing.T) {
+	_, rec := testFrameContext(t)
+	viper.Set("HA_DISCOVERY", true)
+	viper.Set("ENTITY_OVERRIDES", map[string]interface{}{
+		"meter_power_demand": map[string]interface{}{"unique_id": "mains_power"},
+	})
+	setupMQTTDiscovery(rec)
+
+	old := discoveryPrefix() + "/sensor/meter_power_demand/config"
+	moved := discoveryPrefix() + "/sensor/mains_power/config"
+	if got, ok := rec.last(old); !ok || got != "" {
+		t.Errorf("default discovery topic left with %q, want it cleared", got)
+	}
+	if got, _ := rec.last(moved); !strings.Contains(got, `"unique_id":"mains_power"`) {
+		t.Errorf("overridden discovery config is %q", got)
+	}
+	if _, ok := rec.last(discoveryPrefix() + "/sensor/meter_total_energy_delivered/config"); !ok {
+		t.Error("entity without an override not published")
+	}
+	for _, msg := range rec.msgs {
+		if msg.topic == discoveryPrefix()+"/sensor/meter_total_energy_delivered/config" && msg.payload == "" {
+			t.Error("entity without an override was cleared")
+		}
+	}
+}
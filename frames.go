@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/spf13/viper"
+)
+
+type frameContext struct {
+	m   Publisher
+	w   io.Writer // nil unless reading from the EMU-2 itself
+	dev *emuDevice
+
+	// failures counts consecutive frames that could not be decoded; a long
+	// run means the scanner has lost sync with the frame boundaries.
+	failures int
+
+	// last holds the most recent frame of each type, to spot dongle
+	// retransmissions.
+	last map[string][]byte
+
+	// decoding is set by "emu2mqtt decode", whose frames are not counted.
+	decoding bool
+}
+
+type frameHandler func(fc *frameContext, data []byte)
+
+// frameHandlers maps the XML root element of each EMU-2 fragment to its
+// handler. Supporting a new message type only needs an entry here.
+var frameHandlers = map[string]frameHandler{
+	"InstantaneousDemand":       handleInstantaneousDemand,
+	"CurrentSummationDelivered": handleCurrentSummationDelivered,
+	"PriceCluster":              handlePriceCluster,
+	"ConnectionStatus":          handleConnectionStatus,
+	"NetworkInfo":               handleNetworkInfo,
+	"CurrentPeriodUsage":        handleCurrentPeriodUsage,
+	"LastPeriodUsage":           handleLastPeriodUsage,
+	"Message":                   handleMessage,
+	"MessageCluster":            handleMessage,
+	"TimeCluster":               handleTimeCluster,
+	"ScheduleInfo":              handleScheduleInfo,
+	"ProfileData":               handleProfileData,
+	"DeviceInfo":                handleDeviceInfo,
+	"BlockPriceDetail":          handleBlockPriceDetail,
+}
+
+var validate = newValidator()
+
+// EMU-2 firmware writes hex fields as "0x"-prefixed lowercase, but older
+// RAVEn-style firmware omits the prefix, some use uppercase, and
+// pretty-printed frames can carry surrounding whitespace. The emuhex tag and
+// parseHex accept all of these, unlike the built-in "hexadecimal" tag paired
+// with base-0 strconv parsing, which would read an unprefixed "0123" as octal.
+var emuHexPattern = regexp.MustCompile(`^(0[xX])?[0-9a-fA-F]+$`)
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterValidation("emuhex", func(fl validator.FieldLevel) bool {
+		return emuHexPattern.MatchString(strings.TrimSpace(fl.Field().String()))
+	})
+	return v
+}
+
+func parseHex(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+	}
+	u, err := strconv.ParseUint(s, 16, 64)
+	return int64(u), err
+}
+
+// parseSignedHex reads s as a two's-complement value of the given width in
+// bits. A width of 0 takes it from the number of hex digits the meter wrote,
+// e.g. 32 bits for "0xFFFFFF38", so exported demand comes out negative
+// whatever width the firmware uses. Inferred widths are at least 32 bits, as
+// short unpadded values such as "0xA" are positive.
+func parseSignedHex(s string, bits int) (int64, error) {
+	v, err := parseHex(s)
+	if err != nil {
+		return 0, err
+	}
+	if bits == 0 {
+		digits := strings.TrimSpace(s)
+		if len(digits) > 2 && digits[0] == '0' && (digits[1] == 'x' || digits[1] == 'X') {
+			digits = digits[2:]
+		}
+		bits = max(4*len(digits), 32)
+	}
+	if bits <= 0 || bits > 64 {
+		return 0, fmt.Errorf("invalid width %d for %q", bits, s)
+	}
+	if bits < 64 {
+		if uint64(v)>>bits != 0 {
+			return 0, fmt.Errorf("%q does not fit in %d bits", s, bits)
+		}
+		if v&(1<<(bits-1)) != 0 {
+			v -= 1 << bits
+		}
+	}
+	return v, nil
+}
+
+// decodeFrame unmarshals a fragment into v and runs the struct validation
+// tags, so handlers only see frames with every required field present.
+func decodeFrame(data []byte, v interface{}) error {
+	if err := xml.Unmarshal(data, v); err != nil {
+		return err
+	}
+	return validate.Struct(v)
+}
+
+// splitFrames is a bufio.SplitFunc yielding one fragment per token, from its
+// opening tag through the closing tag; anything before the opening tag is
+// skipped. A fragment is any element whose opening tag ends its line, as the
+// EMU-2 writes each field on a line of its own, so frame types without a
+// handler are split out too. Spaces or tabs some firmware leaves between the
+// closing tag and the line ending are consumed but not part of the token,
+// and the line ending may be "\r\n" or a bare "\n".
+func splitFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i := 0; ; {
+		j := bytes.Index(data[i:], []byte("</"))
+		if j < 0 {
+			return 0, nil, nil
+		}
+		closing := i + j
+		k := bytes.IndexByte(data[closing:], '>')
+		if k < 0 {
+			return 0, nil, nil
+		}
+		tagEnd := closing + k + 1
+		i = tagEnd
+		opening := append([]byte{'<'}, data[closing+2:tagEnd]...)
+		start := bytes.LastIndex(data[:closing], opening)
+		if start < 0 || !endsLine(data[start+len(opening):closing]) {
+			// A field's closing tag, or a fragment whose opening tag was
+			// lost.
+			continue
+		}
+		n, ok := lineEnding(data[tagEnd:], atEOF)
+		if !ok {
+			return 0, nil, nil
+		}
+		return tagEnd + n, data[start:tagEnd], nil
+	}
+}
+
+// endsLine reports whether rest starts with optional spaces or tabs and a
+// line ending, as it does after a fragment's opening tag.
+func endsLine(rest []byte) bool {
+	rest = bytes.TrimLeft(rest, " \t")
+	return bytes.HasPrefix(rest, []byte("\r\n")) || bytes.HasPrefix(rest, []byte("\n"))
+}
+
+// lineEnding returns how many bytes of trailing whitespace and line ending
+// follow a closing tag. It reports false when the data ends inside that
+// whitespace and more input could still complete it.
+func lineEnding(rest []byte, atEOF bool) (int, bool) {
+	n := 0
+	for n < len(rest) && (rest[n] == ' ' || rest[n] == '\t') {
+		n++
+	}
+	switch {
+	case bytes.HasPrefix(rest[n:], []byte("\r\n")):
+		return n + 2, true
+	case bytes.HasPrefix(rest[n:], []byte("\n")):
+		return n + 1, true
+	case len(rest[n:]) < 2 && !atEOF:
+		return 0, false
+	default:
+		return n, true
+	}
+}
+
+func (fc *frameContext) decode(data []byte, v interface{}) error {
+	err := decodeFrame(data, v)
+	if err != nil {
+		fc.failures++
+		fc.countInvalid()
+	} else {
+		fc.failures = 0
+		markFrameReceived()
+	}
+	return err
+}
+
+// malformed skips a frame whose fields passed validation but could not be
+// converted; one corrupt frame is not worth stopping the daemon over.
+func (fc *frameContext) malformed(frame string, err error) {
+	slog.Warn("Skipping malformed frame", "frame", frame, "err", err)
+	fc.failures++
+	fc.countInvalid()
+}
+
+// countInvalid adds a frame that could not be used to the parse error
+// metric and the invalid frame counter.
+func (fc *frameContext) countInvalid() {
+	if fc.decoding {
+		return
+	}
+	parseErrorsCounter.WithLabelValues(fc.dev.Name).Inc()
+	countInvalidFrame()
+}
+
+func frameName(data []byte) string {
+	if len(data) < 2 || data[0] != '<' {
+		return ""
+	}
+	if i := bytes.IndexAny(data, "> \r\n"); i > 1 {
+		return string(data[1:i])
+	}
+	return ""
+}
+
+var duplicatesDropped atomic.Int64
+
+// isDuplicate reports whether data repeats the previous frame of the same
+// type: the same decoded timestamp and identical values. Zigbee retries make
+// the dongle resend frames, which would otherwise be counted twice. Frames
+// without a timestamp are never treated as duplicates.
+func (fc *frameContext) isDuplicate(name string, data []byte) bool {
+	var frame struct {
+		TimeStamp string
+	}
+	if xml.Unmarshal(data, &frame) != nil || frame.TimeStamp == "" {
+		return false
+	}
+	data = bytes.TrimSpace(data)
+	prev := fc.last[name]
+	if fc.last == nil {
+		fc.last = make(map[string][]byte)
+	}
+	fc.last[name] = append([]byte(nil), data...)
+	return bytes.Equal(prev, data)
+}
+
+// rawTopic is where PUBLISH_RAW forwards a device's frames of one type
+// verbatim, e.g. "homeassistant/meter/raw/InstantaneousDemand".
+func rawTopic(dev *emuDevice, frame string) string {
+	return topicPrefix() + "/" + dev.Prefix + "/raw/" + frame
+}
+
+func dispatchFrame(fc *frameContext, data []byte) {
+	// Serial line noise can produce empty or one-byte tokens; they are
+	// never an XML element.
+	data = bytes.TrimSpace(data)
+	name := frameName(data)
+	if name == "" {
+		slog.Warn("Skipping data that is not an XML element", "data", string(data))
+		fc.failures++
+		fc.countInvalid()
+		return
+	}
+	if viper.GetBool("PUBLISH_RAW") {
+		publishState(fc.m, rawTopic(fc.dev, name), false, redactPairingSecrets(data))
+	}
+	handler, ok := frameHandlers[name]
+	if !ok {
+		// A well-formed frame of a type the bridge does not decode, which
+		// says nothing about the scanner being out of sync.
+		slog.Debug("Skipping unrecognized frame", "frame", name)
+		return
+	}
+	meter, device := frameMACs(data)
+	if !fc.dev.acceptsMeter(meter) {
+		slog.Debug("Skipping frame from another meter", "frame", name, "meter_mac", meter)
+		fc.dev.rejectMeter(meter)
+		return
+	}
+	fc.dev.learnMAC(fc.m, meter, device)
+	if viper.GetBool("DEDUP_FRAMES") && fc.isDuplicate(name, data) {
+		slog.Debug("Dropping duplicate frame", "frame", name)
+		if fc.decoding {
+			return
+		}
+		n := duplicatesDropped.Add(1)
+		fc.m.Publish(stateTopic("emu2mqtt_duplicates_dropped"), 0, true, strconv.FormatInt(n, 10))
+		return
+	}
+	// Counted only once it is known to be new, so retransmissions show up
+	// in the duplicates counter alone.
+	if !fc.decoding {
+		countFrame(name)
+	}
+	handler(fc, data)
+}
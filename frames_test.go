@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/spf13/viper"
+)
+
+// splitAll runs stream through splitFrames and returns every token.
+func splitAll(t *testing.T, stream string) []string {
+	t.Helper()
+	return splitReader(t, strings.NewReader(stream))
+}
+
+func splitReader(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	scanner := bufio.NewScanner(r)
+	scanner.Split(splitFrames)
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+const unknownFrame = "<FastPollStatus>\r\n" +
+	"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+	"  <Frequency>0x00</Frequency>\r\n" +
+	"</FastPollStatus>\r\n"
+
+func TestSplitFramesUnknownType(t *testing.T) {
+	tokens := splitAll(t, unknownFrame+demandFrame)
+	if len(tokens) != 2 {
+		t.Fatalf("got %d tokens, want 2: %q", len(tokens), tokens)
+	}
+	if want := strings.TrimSuffix(unknownFrame, "\r\n"); tokens[0] != want {
+		t.Errorf("first token = %q, want %q", tokens[0], want)
+	}
+	if frameName([]byte(tokens[1])) != "InstantaneousDemand" {
+		t.Errorf("second token = %q", tokens[1])
+	}
+}
+
+func TestSplitFramesSkipsOrphanedFields(t *testing.T) {
+	// The tail of a frame whose opening tag was lost.
+	orphan := "  <Demand>0x0004d2</Demand>\r\n</InstantaneousDemand>\r\n"
+	tokens := splitAll(t, orphan+demandFrame)
+	if len(tokens) != 1 || tokens[0] != strings.TrimSuffix(demandFrame, "\r\n") {
+		t.Errorf("tokens = %q, want only the complete frame", tokens)
+	}
+}
+
+func TestPublishRawUnknownFrame(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	viper.Set("PUBLISH_RAW", true)
+	for _, token := range splitAll(t, unknownFrame+demandFrame) {
+		dispatchFrame(fc, []byte(token))
+	}
+	if _, ok := rec.last(rawTopic(fc.dev, "FastPollStatus")); !ok {
+		t.Error("unknown frame not forwarded raw")
+	}
+	if _, ok := rec.last(rawTopic(fc.dev, "InstantaneousDemand")); !ok {
+		t.Error("demand frame not forwarded raw")
+	}
+	if fc.failures != 0 {
+		t.Errorf("unknown frame counted as %d decode failures", fc.failures)
+	}
+}
+
+func TestDuplicateFrameCountedOnce(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	frames := frameCounts["InstantaneousDemand"].Load()
+	dropped := duplicatesDropped.Load()
+
+	dispatchFrame(fc, []byte(demandFrame))
+	dispatchFrame(fc, []byte(demandFrame))
+
+	if n := frameCounts["InstantaneousDemand"].Load() - frames; n != 1 {
+		t.Errorf("demand frame counted %d times, want 1", n)
+	}
+	if n := duplicatesDropped.Load() - dropped; n != 1 {
+		t.Errorf("%d duplicates dropped, want 1", n)
+	}
+	if got := rec.states(); len(got) != 2 || got[0] != stateTopic("meter_power_demand")+"=1234" {
+		t.Errorf("published %q, want the demand then the duplicates counter", got)
+	}
+}
+
+func TestParseSignedHex(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		bits    int
+		want    int64
+		wantErr bool
+	}{
+		{"0x000004d2", 0, 1234, false},
+		{"0x0004d2", 0, 1234, false},
+		{"0x00000000", 0, 0, false},
+		{"0x7FFFFFFF", 0, 2147483647, false},
+		{"0x80000000", 0, -2147483648, false},
+		{"0xFFFFFFFF", 0, -1, false},
+		{"0xFFFFFF38", 0, -200, false},
+		{"FFFFFF38", 0, -200, false},
+		{"0xA", 0, 10, false},
+		{"0xFFFF", 16, -1, false},
+		{"0x00FFFFFF", 24, -1, false},
+		{"0x01000000", 24, 0, true},
+		{"0x10000", 16, 0, true},
+		{"0xFFFFFFFFFFFFFFFF", 0, -1, false},
+		{"0x1", 65, 0, true},
+		{"0xZZ", 0, 0, true},
+	} {
+		got, err := parseSignedHex(tc.in, tc.bits)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseSignedHex(%q, %d) error = %v, want error %t", tc.in, tc.bits, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got != tc.want {
+			t.Errorf("parseSignedHex(%q, %d) = %d, want %d", tc.in, tc.bits, got, tc.want)
+		}
+	}
+}
+
+// chunkReader reads at most n bytes at a time, so frames arrive split
+// across reads at every offset.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func TestSplitFramesAcrossReads(t *testing.T) {
+	lf := strings.ReplaceAll(summationFrame, "\r\n", "\n")
+	stream := "junk\r\n" + demandFrame + lf + demandFrame
+	want := []string{
+		strings.TrimSuffix(demandFrame, "\r\n"),
+		strings.TrimSuffix(lf, "\n"),
+		strings.TrimSuffix(demandFrame, "\r\n"),
+	}
+	for n := 1; n <= 64; n++ {
+		got := splitReader(t, chunkReader{strings.NewReader(stream), n})
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf("reads of %d bytes: got %q", n, got)
+		}
+	}
+	if got := splitReader(t, iotest.OneByteReader(strings.NewReader(lf+lf))); len(got) != 2 {
+		t.Errorf("LF frames a byte at a time: got %d tokens", len(got))
+	}
+}
+
+func TestSplitFramesWaitsForLineEnding(t *testing.T) {
+	frame := strings.TrimSuffix(demandFrame, "\r\n")
+	for _, tc := range []struct {
+		data    string
+		atEOF   bool
+		advance int
+	}{
+		// The "\r" of the closing line has not arrived yet.
+		{frame, false, 0},
+		// The "\n" after it may still follow.
+		{frame + "\r", false, 0},
+		{frame + "  ", false, 0},
+		{frame + "\r\n", false, len(frame) + 2},
+		{frame + "\n", false, len(frame) + 1},
+		{frame + " \t\r\n", false, len(frame) + 4},
+		{frame, true, len(frame)},
+		// A partial frame is left for the next read.
+		{frame[:len(frame)-5], false, 0},
+		{frame[:len(frame)-5], true, 0},
+	} {
+		advance, token, err := splitFrames([]byte(tc.data), tc.atEOF)
+		if err != nil || advance != tc.advance {
+			t.Errorf("splitFrames(%q, %t) = %d, %v; want %d", tc.data[len(tc.data)-8:], tc.atEOF, advance, err, tc.advance)
+			continue
+		}
+		if advance > 0 && string(token) != frame {
+			t.Errorf("splitFrames(%q, %t) token = %q", tc.data[len(tc.data)-8:], tc.atEOF, token)
+		}
+	}
+}
+
+func TestDispatchFrameShortTokens(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	invalid := invalidFrames.Load()
+	tokens := []string{"", "<", "x", " ", "\r\n", "<>", "</", "<<", "\x00\xff"}
+	for _, token := range tokens {
+		dispatchFrame(fc, []byte(token))
+	}
+	if len(rec.msgs) != 0 {
+		t.Errorf("noise published %v", rec.msgs)
+	}
+	if n := invalidFrames.Load() - invalid; n != int64(len(tokens)) {
+		t.Errorf("%d of %d noise tokens counted invalid", n, len(tokens))
+	}
+	dispatchFrame(fc, []byte(demandFrame))
+	if got, _ := rec.last(stateTopic("meter_power_demand")); got != "1234" {
+		t.Errorf("demand after noise = %q, want 1234", got)
+	}
+}
+
+func TestLFTerminatedDemand(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	lf := strings.ReplaceAll(demandFrame, "\r\n", "\n")
+	later := strings.Replace(strings.Replace(lf, "0x0004d2", "0x000100", 1), "0x2c3a1b00", "0x2c3a1b08", 1)
+	tokens := splitAll(t, lf+later)
+	if len(tokens) != 2 {
+		t.Fatalf("got %d tokens from LF-terminated frames, want 2: %q", len(tokens), tokens)
+	}
+	for _, token := range tokens {
+		if strings.HasSuffix(token, "\n") {
+			t.Errorf("token keeps its line ending: %q", token)
+		}
+		dispatchFrame(fc, []byte(token))
+	}
+	want := stateTopic("meter_power_demand") + "=1234," + stateTopic("meter_power_demand") + "=256"
+	if got := strings.Join(rec.states(), ","); got != want {
+		t.Errorf("published %s, want %s", got, want)
+	}
+}
+
+func TestFrameHandlerRegistration(t *testing.T) {
+	const frame = "<WeatherCluster>\r\n" +
+		"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+		"  <MeterMacId>0x00135003000abcde</MeterMacId>\r\n" +
+		"  <Temperature>0x00d2</Temperature>\r\n" +
+		"</WeatherCluster>\r\n"
+	fc, _ := testFrameContext(t)
+	var handled []string
+	frameHandlers["WeatherCluster"] = func(fc *frameContext, data []byte) {
+		handled = append(handled, string(data))
+	}
+	t.Cleanup(func() { delete(frameHandlers, "WeatherCluster") })
+
+	tokens := splitAll(t, unknownFrame+frame+demandFrame)
+	if len(tokens) != 3 {
+		t.Fatalf("got %d tokens, want 3: %q", len(tokens), tokens)
+	}
+	for _, token := range tokens {
+		dispatchFrame(fc, []byte(token))
+	}
+	if want := strings.TrimSuffix(frame, "\r\n"); len(handled) != 1 || handled[0] != want {
+		t.Errorf("handler got %q, want just %q", handled, want)
+	}
+	if _, ok := frameHandlers["FastPollStatus"]; ok {
+		t.Fatal("FastPollStatus has a handler; pick another unhandled frame")
+	}
+	if fc.failures != 0 {
+		t.Errorf("%d failures after an unhandled frame", fc.failures)
+	}
+}
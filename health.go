@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// health is what the readiness probe looks at: whether the broker
+// connection is up and when a frame last decoded cleanly.
+var health struct {
+	mqttConnected atomic.Bool
+	lastFrame     atomic.Int64 // Unix nanoseconds
+}
+
+func markFrameReceived() {
+	health.lastFrame.Store(clock.Now().UnixNano())
+}
+
+func ready() (bool, string) {
+	if !health.mqttConnected.Load() {
+		return false, "MQTT not connected"
+	}
+	last := health.lastFrame.Load()
+	if last == 0 {
+		return false, "no frame received yet"
+	}
+	if age := clock.Now().Sub(time.Unix(0, last)); age > viper.GetDuration("HEALTH_FRAME_MAX_AGE") {
+		return false, "no frame received for " + age.Round(time.Second).String()
+	}
+	return true, "ok"
+}
+
+// serveHealth exposes liveness and readiness probes on HEALTH_ADDR for
+// container orchestrators: /healthz answers while the process is up,
+// /readyz only while the bridge is actually relaying readings.
+func serveHealth() {
+	addr := viper.GetString("HEALTH_ADDR")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		ok, reason := ready()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(reason + "\n"))
+	})
+	go func() {
+		log.Print("Serving health checks on ", addr)
+		log.Print("Health server stopped: ", http.ListenAndServe(addr, mux))
+	}()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// alignedStart returns the start of the clock-aligned interval of length d
+// containing t, in the configured timezone. It works on the instant's own
+// UTC offset rather than rebuilding a wall-clock time, so the repeated hour
+// at a DST fall-back and zones with half-hour offsets both bucket correctly.
+func alignedStart(t time.Time, d time.Duration) time.Time {
+	t = t.In(location)
+	_, offset := t.Zone()
+	shifted := t.Add(time.Duration(offset) * time.Second).Truncate(d)
+	return shifted.Add(-time.Duration(offset) * time.Second).In(location)
+}
+
+// updateHourlyEnergy adds the energy delivered since the previous summation
+// to the current clock hour's bucket, starting a new bucket when the frame
+// falls in a later hour. The in-progress bucket is persisted so a restart
+// mid-hour keeps it.
+func updateHourlyEnergy(m Publisher, delivered float64, timestamp string) {
+	if !viper.GetBool("HOURLY_ENERGY") {
+		return
+	}
+	t, err := parseEmuTimestamp(timestamp)
+	if err != nil {
+		t = clock.Now()
+	}
+	hour := alignedStart(t, time.Hour)
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	var delta float64
+	if persisted.HourBaselineSet && delivered >= persisted.HourBaselineKWh {
+		delta = delivered - persisted.HourBaselineKWh
+	}
+	persisted.HourBaselineKWh = delivered
+	persisted.HourBaselineSet = true
+
+	// A clock stepping backwards keeps filling the current bucket rather
+	// than reopening an hour that was already reported.
+	if hour.After(persisted.HourStart) {
+		persisted.PreviousHourKWh = persisted.HourEnergyKWh
+		persisted.HourStart = hour
+		persisted.HourEnergyKWh = 0
+	}
+	persisted.HourEnergyKWh += delta
+	stateDirty = true
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"hour_start":        formatTimestamp(persisted.HourStart),
+		"previous_hour_kwh": persisted.PreviousHourKWh,
+	})
+	m.Publish(attributesTopic("meter_energy_hourly"), 0, true, b)
+	m.Publish(stateTopic("meter_energy_hourly"), 0, true, formatEnergy(persisted.HourEnergyKWh))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var errSerialIdle = errors.New("no data from the EMU-2")
+
+// idleReader fails with errSerialIdle once the underlying reader has
+// delivered nothing for timeout. The serial port is opened with a read
+// timeout, so a silent port returns empty reads instead of blocking forever;
+// this turns a long run of them into an error that reopens the port.
+// tarm/serial reports a timed-out read as (0, io.EOF), so that counts as an
+// empty read too.
+type idleReader struct {
+	r        io.Reader
+	timeout  time.Duration
+	activity time.Time
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration) *idleReader {
+	return &idleReader{r: r, timeout: timeout, activity: clock.Now()}
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	for {
+		n, err := i.r.Read(p)
+		if n > 0 {
+			i.activity = clock.Now()
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if clock.Now().Sub(i.activity) > i.timeout {
+			return 0, errSerialIdle
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// timingOutPort behaves like tarm/serial with a read timeout: it delivers
+// its data and then reports each timed-out read as (0, io.EOF), each one
+// taking a second of the fake clock.
+type timingOutPort struct {
+	c     *fakeClock
+	data  []byte
+	reads int
+}
+
+func (p *timingOutPort) Read(b []byte) (int, error) {
+	p.c.advance(time.Second)
+	if len(p.data) > 0 {
+		n := copy(b, p.data)
+		p.data = p.data[n:]
+		return n, nil
+	}
+	p.reads++
+	return 0, io.EOF
+}
+
+func TestIdleReaderTreatsTimeoutEOFAsEmptyRead(t *testing.T) {
+	c := useFakeClock(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	port := &timingOutPort{c: c, data: []byte("<Frame/>")}
+	r := newIdleReader(port, 5*time.Second)
+
+	buf := make([]byte, 64)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "<Frame/>" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	start := c.Now()
+	_, err := r.Read(buf)
+	if !errors.Is(err, errSerialIdle) {
+		t.Fatalf("Read on a silent port = %v, want errSerialIdle", err)
+	}
+	if waited := c.Now().Sub(start); waited <= 5*time.Second {
+		t.Errorf("gave up after %v, before the 5s timeout", waited)
+	}
+	if port.reads < 5 {
+		t.Errorf("gave up after %d empty reads", port.reads)
+	}
+}
+
+func TestIdleReaderPassesOtherErrors(t *testing.T) {
+	useFakeClock(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	unplugged := errors.New("device unplugged")
+	r := newIdleReader(&failingReader{err: unplugged}, 5*time.Second)
+	if _, err := r.Read(make([]byte, 8)); !errors.Is(err, unplugged) {
+		t.Errorf("Read = %v, want the port error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConnectionStatus struct {
+	XMLName      xml.Name `xml:"ConnectionStatus"`
+	DeviceMacId  string   `xml:"DeviceMacId"`
+	MeterMacId   string   `xml:"MeterMacId"`
+	Status       string   `xml:"Status" validate:"required"`
+	Description  string   `xml:"Description"`
+	StatusCode   string   `xml:"StatusCode"`
+	ExtPanId     string   `xml:"ExtPanId"`
+	Channel      string   `xml:"Channel"`
+	ShortAddr    string   `xml:"ShortAddr"`
+	LinkStrength string   `xml:"LinkStrength"`
+}
+
+type NetworkInfo struct {
+	XMLName      xml.Name `xml:"NetworkInfo"`
+	DeviceMacId  string   `xml:"DeviceMacId"`
+	CoordMacId   string   `xml:"CoordMacId"`
+	Status       string   `xml:"Status" validate:"required"`
+	Description  string   `xml:"Description"`
+	StatusCode   string   `xml:"StatusCode"`
+	ExtPanId     string   `xml:"ExtPanId"`
+	Channel      string   `xml:"Channel"`
+	ShortAddr    string   `xml:"ShortAddr"`
+	LinkStrength string   `xml:"LinkStrength"`
+}
+
+func meterLinkTopic() string {
+	return topicPrefix() + "/binary_sensor/meter_link/state"
+}
+
+// linkTracker remembers when the Zigbee link to the meter last came up, so
+// link stability is visible at a glance.
+type linkTracker struct {
+	mu        sync.Mutex
+	connected bool
+	since     time.Time
+}
+
+var meterLink linkTracker
+
+func (l *linkTracker) update(m Publisher, connected bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if connected == l.connected && !l.since.IsZero() {
+		return
+	}
+	l.connected = connected
+	l.since = clock.Now()
+	if connected {
+		log.Print("Meter link connected")
+		m.Publish(stateTopic("meter_link_uptime"), 0, true, formatTimestamp(l.since))
+	} else {
+		log.Print("Meter link disconnected")
+		m.Publish(stateTopic("meter_link_uptime"), 0, true, "None")
+	}
+}
+
+func handleConnectionStatus(fc *frameContext, data []byte) {
+	var connectionStatus ConnectionStatus
+	if err := fc.decode(data, &connectionStatus); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if fc.dev.primary() {
+		publishLinkStatus(fc.m, connectionStatus.Status, connectionStatus.Description, connectionStatus.LinkStrength, connectionStatus.Channel)
+	}
+}
+
+// NetworkInfo carries the same Zigbee status as ConnectionStatus, along with
+// the network details; the EMU-2 sends it periodically.
+func handleNetworkInfo(fc *frameContext, data []byte) {
+	var networkInfo NetworkInfo
+	if err := fc.decode(data, &networkInfo); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if fc.dev.primary() {
+		publishLinkStatus(fc.m, networkInfo.Status, networkInfo.Description, networkInfo.LinkStrength, networkInfo.Channel)
+	}
+}
+
+// publishLinkStatus reports whether the EMU-2 has a Zigbee link to the
+// meter, independently of the USB side, and how strong that link is. The
+// join state ("Scanning", "Joining", "Connected", ...) and the Zigbee
+// channel are published as diagnostics for correlating dropouts.
+func publishLinkStatus(m Publisher, status, description, linkStrength, channel string) {
+	connected := status == "Connected"
+	meterLink.update(m, connected)
+	payload := "OFF"
+	if connected {
+		payload = "ON"
+	}
+	m.Publish(meterLinkTopic(), 0, true, payload)
+	b, _ := json.Marshal(map[string]string{"description": description})
+	m.Publish(attributesTopic("meter_link_status"), 0, true, b)
+	m.Publish(stateTopic("meter_link_status"), 0, true, status)
+	if channel != "" {
+		if ch, err := parseChannel(channel); err == nil {
+			m.Publish(stateTopic("meter_link_channel"), 0, true, strconv.FormatInt(ch, 10))
+		} else {
+			slog.Warn("Ignoring invalid channel", "value", channel, "err", err)
+		}
+	}
+	if linkStrength == "" {
+		return
+	}
+	// The EMU-2 reports the link strength as a percentage, 0x00 to 0x64,
+	// published as a 0-255 signal value. Firmware that goes past 0x64 is
+	// at full strength.
+	percent, err := parseHex(linkStrength)
+	if err != nil {
+		slog.Warn("Ignoring invalid link strength", "value", linkStrength, "err", err)
+		return
+	}
+	strength := int64(math.Round(float64(min(percent, 100)) * 255 / 100))
+	m.Publish(stateTopic("meter_link_strength"), 0, true, strconv.FormatInt(strength, 10))
+}
+
+// parseChannel reads the Zigbee channel, which firmware writes either as
+// hex ("0x14") or as a plain decimal number ("20").
+func parseChannel(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return parseHex(s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLinkStrengthRange(t *testing.T) {
+	for _, tc := range []struct {
+		raw, want string
+	}{
+		{"0x00", "0"},
+		{"0x3C", "153"},
+		{"0x64", "255"},
+		{"0x65", "255"},
+		{"0xFF", "255"},
+		{"strong", ""},
+	} {
+		_, rec := testFrameContext(t)
+		publishLinkStatus(rec, "Connected", "", tc.raw, "")
+		if got, _ := rec.last(stateTopic("meter_link_strength")); got != tc.want {
+			t.Errorf("link strength %s published as %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+}
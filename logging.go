@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging routes all output through slog at LOG_LEVEL. Once a custom
+// handler is the slog default, the standard log package writes through it
+// too, at info level.
+func setupLogging() error {
+	level, ok := logLevels[strings.ToLower(viper.GetString("LOG_LEVEL"))]
+	if !ok {
+		return fmt.Errorf("invalid LOG_LEVEL %q, expected debug, info, warn or error", viper.GetString("LOG_LEVEL"))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	if label := viper.GetString("INSTANCE_LABEL"); label != "" && viper.GetBool("LOG_INSTANCE_LABEL") {
+		logger = logger.With("instance", label)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Frames as captured from an EMU-2: 1234 W of demand, 12345.678 kWh
+// delivered with nothing received, the meter's clock and the dongle's
+// get_device_info reply.
+const (
+	demandFrame = "<InstantaneousDemand>\r\n" +
+		"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+		"  <MeterMacId>0x00135003000abcde</MeterMacId>\r\n" +
+		"  <TimeStamp>0x2c3a1b00</TimeStamp>\r\n" +
+		"  <Demand>0x0004d2</Demand>\r\n" +
+		"  <Multiplier>0x00000001</Multiplier>\r\n" +
+		"  <Divisor>0x000003e8</Divisor>\r\n" +
+		"  <DigitsRight>0x03</DigitsRight>\r\n" +
+		"  <DigitsLeft>0x0f</DigitsLeft>\r\n" +
+		"  <SuppressLeadingZero>Y</SuppressLeadingZero>\r\n" +
+		"</InstantaneousDemand>\r\n"
+	summationFrame = "<CurrentSummationDelivered>\r\n" +
+		"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+		"  <MeterMacId>0x00135003000abcde</MeterMacId>\r\n" +
+		"  <TimeStamp>0x2c3a1b3c</TimeStamp>\r\n" +
+		"  <SummationDelivered>0x0000000000bc614e</SummationDelivered>\r\n" +
+		"  <SummationReceived>0x0000000000000000</SummationReceived>\r\n" +
+		"  <Multiplier>0x00000001</Multiplier>\r\n" +
+		"  <Divisor>0x000003e8</Divisor>\r\n" +
+		"  <DigitsRight>0x03</DigitsRight>\r\n" +
+		"  <DigitsLeft>0x06</DigitsLeft>\r\n" +
+		"  <SuppressLeadingZero>Y</SuppressLeadingZero>\r\n" +
+		"</CurrentSummationDelivered>\r\n"
+	// The meter's clock in UTC, with local time four hours behind.
+	timeFrame = "<TimeCluster>\r\n" +
+		"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+		"  <MeterMacId>0x00135003000abcde</MeterMacId>\r\n" +
+		"  <UTCTime>0x2c3a1b00</UTCTime>\r\n" +
+		"  <LocalTime>0x2c39e2c0</LocalTime>\r\n" +
+		"</TimeCluster>\r\n"
+	deviceInfoFrame = "<DeviceInfo>\r\n" +
+		"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+		"  <InstallCode>0x8ba7f1dee6c4f5cc</InstallCode>\r\n" +
+		"  <LinkKey>0x2b6e4c3a8f91b8e4d7f5a2c1e9b6d3f0</LinkKey>\r\n" +
+		"  <FWVersion>2.0.0 (7400)</FWVersion>\r\n" +
+		"  <HWVersion>2.7.3</HWVersion>\r\n" +
+		"  <ImageType>0x2201</ImageType>\r\n" +
+		"  <Manufacturer>Rainforest Automation, Inc.</Manufacturer>\r\n" +
+		"  <ModelId>Z105-2-EMU2-LEDD_JM</ModelId>\r\n" +
+		"  <DateCode>2013103023220630</DateCode>\r\n" +
+		"</DeviceInfo>\r\n"
+)
+
+// published is one message a recordingPublisher saw.
+type published struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// recordingPublisher stands in for the MQTT client and keeps every publish.
+type recordingPublisher struct {
+	mu   sync.Mutex
+	msgs []published
+}
+
+func (r *recordingPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var s string
+	switch p := payload.(type) {
+	case []byte:
+		s = string(p)
+	case string:
+		s = p
+	}
+	r.mu.Lock()
+	r.msgs = append(r.msgs, published{topic, retained, s})
+	r.mu.Unlock()
+	return &mqtt.DummyToken{}
+}
+
+// states returns the state topic publishes, in order, as "topic=payload".
+func (r *recordingPublisher) states() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for _, m := range r.msgs {
+		if strings.HasSuffix(m.topic, "/state") {
+			out = append(out, m.topic+"="+m.payload)
+		}
+	}
+	return out
+}
+
+// last returns the latest payload published to topic.
+func (r *recordingPublisher) last(topic string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.msgs) - 1; i >= 0; i-- {
+		if r.msgs[i].topic == topic {
+			return r.msgs[i].payload, true
+		}
+	}
+	return "", false
+}
+
+// resetBridge puts the configuration and the per-meter state back to their
+// defaults, with a single device and no discovery, so each test starts
+// from a fresh bridge.
+func resetBridge(t *testing.T) {
+	t.Helper()
+	viper.Reset()
+	setDefaults()
+	viper.Set("HA_DISCOVERY", false)
+	state = meterState{}
+	persistMu.Lock()
+	persisted, stateDirty, liveSummation, liveDemand = persistedState{}, false, false, false
+	persistMu.Unlock()
+	throttle = publishThrottle{}
+	priceTier.Store(0)
+	duplicates = duplicateFilter{}
+	if err := loadDevices(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+// testFrameContext returns a frameContext for the primary device that
+// publishes to a new recordingPublisher.
+func testFrameContext(t *testing.T) (*frameContext, *recordingPublisher) {
+	t.Helper()
+	resetBridge(t)
+	rec := &recordingPublisher{}
+	return &frameContext{m: rec, dev: primaryDevice()}, rec
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigurationMalformedYAML(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	path := writeConfig(t, "MQTT_HOST: broker\nMQTT_PORT: [1883\nSERIAL_PORT: /dev/ttyACM0\n")
+	viper.Set("CONFIG", path)
+
+	err := readConfiguration()
+	if err == nil {
+		t.Fatal("malformed config was accepted")
+	}
+	msg := err.Error()
+	for _, want := range []string{path, "not valid YAML", "line"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q does not mention %q", msg, want)
+		}
+	}
+}
+
+func TestConfigurationPrecedence(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	path := writeConfig(t, "MQTT_HOST: file-broker\nMQTT_PORT: 1884\nSERIAL_BAUD: 9600\n")
+	other := writeConfig(t, "MQTT_HOST: wrong-file\n")
+	t.Setenv("CONFIG", other)
+	t.Setenv("MQTT_HOST", "env-broker")
+	flags := pflag.NewFlagSet("emu2mqtt", pflag.ContinueOnError)
+	flags.String("config", "", "")
+	if err := flags.Parse([]string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	viper.BindPFlag("CONFIG", flags.Lookup("config"))
+
+	if err := readConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"CONFIG":      path,         // flag over environment
+		"MQTT_HOST":   "env-broker", // environment over file
+		"MQTT_PORT":   "1884",       // file over default
+		"SERIAL_BAUD": "9600",
+		"MQTT_QOS":    "0", // default
+	} {
+		if got := viper.GetString(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// failingReader delivers data and then fails with err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestScanSerialReadErrorMidFrame(t *testing.T) {
+	_, rec := testFrameContext(t)
+	glitch := errors.New("usb glitch")
+	r := &failingReader{
+		data: []byte(demandFrame + "<CurrentSummationDelivered>\r\n  <DeviceMacId>0xd8d5b9"),
+		err:  glitch,
+	}
+
+	err := scanSerial(context.Background(), primaryDevice(), r, rec)
+	if !errors.Is(err, glitch) {
+		t.Fatalf("scanSerial returned %v, want the read error", err)
+	}
+	if errors.Is(err, io.EOF) {
+		t.Fatalf("read error reported as EOF: %v", err)
+	}
+	if got, _ := rec.last(stateTopic("meter_power_demand")); got != "1234" {
+		t.Errorf("demand before the error = %q, want 1234", got)
+	}
+}
+
+func TestScanSerialSkipsNonHexMultiplier(t *testing.T) {
+	_, rec := testFrameContext(t)
+	viper.Set("SERIAL_IDLE_TIMEOUT", 0)
+	bad := strings.Replace(demandFrame, "<Multiplier>0x00000001</Multiplier>", "<Multiplier>0xZZ</Multiplier>", 1)
+	bad = strings.Replace(bad, "0x0004d2", "0x000001", 1)
+	invalid := invalidFrames.Load()
+
+	err := scanSerial(context.Background(), primaryDevice(), strings.NewReader(bad+summationFrame+demandFrame), rec)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("scanSerial = %v, want io.EOF after reading every frame", err)
+	}
+	want := []string{
+		stateTopic("meter_total_energy_delivered") + "=12345.678",
+		stateTopic("meter_total_energy_received") + "=0.000",
+		stateTopic("meter_net_energy") + "=12345.678",
+		stateTopic("meter_power_demand") + "=1234",
+	}
+	if got := rec.states(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if n := invalidFrames.Load() - invalid; n != 1 {
+		t.Errorf("%d frames counted invalid, want 1", n)
+	}
+}
+
+func TestComputeDemandWatts(t *testing.T) {
+	for _, tc := range []struct {
+		demand, multiplier, divisor string
+		want                        int
+		wantErr                     bool
+	}{
+		// Captured from an EMU-2.
+		{"0x0004d2", "0x00000001", "0x000003e8", 1234, false},
+		{"0x000123", "0x00000001", "0x000003e8", 291, false},
+		{"0x00000f", "0x00000001", "0x000003e8", 15, false},
+		{"0x0003e9", "0x00000001", "0x000003e8", 1001, false},
+		{"0x0003e9", "0x00000001", "0x00000003", 333667, false},
+		// Whole kW, as some meters report.
+		{"0x000003", "0x00000001", "0x00000001", 3000, false},
+		{"0x0004d2", "0x00000002", "0x000003e8", 2468, false},
+		{"0x0004d2", "0x00000001", "0x00002710", 123, false},
+		// Exported power.
+		{"0xFFFFFF38", "0x00000001", "0x000003e8", -200, false},
+		{"0xfffffb2e", "0x00000001", "0x000003e8", -1234, false},
+		{"0x000000", "0x00000001", "0x000003e8", 0, false},
+		{"0x0004d2", "0x00000001", "0x00000000", 0, true},
+		{"0x0004d2", "0x00000000", "0x000003e8", 0, true},
+		{"0x0004g2", "0x00000001", "0x000003e8", 0, true},
+	} {
+		got, err := computeDemandWatts(InstantaneousDemand{Demand: tc.demand, Multiplier: tc.multiplier, Divisor: tc.divisor})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("demand %s × %s / %s: error %v, want error %t", tc.demand, tc.multiplier, tc.divisor, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("demand %s × %s / %s = %d W, want %d", tc.demand, tc.multiplier, tc.divisor, got, tc.want)
+		}
+	}
+}
+
+func TestComputeSummation(t *testing.T) {
+	nan := math.NaN()
+	for _, tc := range []struct {
+		delivered, received, multiplier, divisor string
+		wantDelivered, wantReceived              float64
+		wantErr                                  bool
+	}{
+		// Captured from an EMU-2.
+		{"0x0000000000bc614e", "0x0000000000000000", "0x00000001", "0x000003e8", 12345.678, 0, false},
+		{"0x00000000000a1b2c", "0x0000000000c35000", "0x00000001", "0x000003e8", 662.316, 12800, false},
+		{"0x00000000000f4240", "0x0000000000000000", "0x0000000a", "0x00002710", 1000, 0, false},
+		// Summations are unsigned: the top bit is not a sign.
+		{"0x0000800000000000", "0x0", "0x00000001", "0x000003e8", 140737488355.328, 0, false},
+		// All ones is the SE "invalid" sentinel, at 48 or 64 bits.
+		{"0x0000000000bc614e", "0xffffffffffff", "0x00000001", "0x000003e8", 12345.678, nan, false},
+		{"0xFFFFFFFFFFFFFFFF", "0x0", "0x00000001", "0x000003e8", nan, 0, false},
+		{"0x0000000000bc614e", "0x0", "0x00000001", "0x00000000", 0, 0, true},
+		{"0x0000000000bc614e", "0x0", "0x00000000", "0x000003e8", 0, 0, true},
+		{"0x0000000000bc614e", "0xZZ", "0x00000001", "0x000003e8", 0, 0, true},
+	} {
+		delivered, received, err := computeSummation(CurrentSummationDelivered{
+			SummationDelivered: tc.delivered,
+			SummationReceived:  tc.received,
+			Multiplier:         tc.multiplier,
+			Divisor:            tc.divisor,
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("summation %s/%s: error %v, want error %t", tc.delivered, tc.received, err, tc.wantErr)
+			continue
+		}
+		if !sameFloat(delivered, tc.wantDelivered) || !sameFloat(received, tc.wantReceived) {
+			t.Errorf("summation %s/%s × %s / %s = %v, %v; want %v, %v", tc.delivered, tc.received, tc.multiplier, tc.divisor,
+				delivered, received, tc.wantDelivered, tc.wantReceived)
+		}
+	}
+}
+
+// sameFloat compares to within rounding, with NaN equal to itself.
+func sameFloat(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) < 1e-9*math.Max(1, math.Abs(b))
+}
+
+func TestZeroScaleFramesSkipped(t *testing.T) {
+	for _, tc := range []struct {
+		name, frame string
+	}{
+		{"summation divisor", strings.Replace(summationFrame, "<Divisor>0x000003e8</Divisor>", "<Divisor>0x00000000</Divisor>", 1)},
+		{"summation multiplier", strings.Replace(summationFrame, "<Multiplier>0x00000001</Multiplier>", "<Multiplier>0x00000000</Multiplier>", 1)},
+		{"demand divisor", strings.Replace(demandFrame, "<Divisor>0x000003e8</Divisor>", "<Divisor>0x00000000</Divisor>", 1)},
+		{"demand multiplier", strings.Replace(demandFrame, "<Multiplier>0x00000001</Multiplier>", "<Multiplier>0x00000000</Multiplier>", 1)},
+	} {
+		fc, rec := testFrameContext(t)
+		invalid := invalidFrames.Load()
+		dispatchFrame(fc, []byte(tc.frame))
+		if got := rec.states(); len(got) != 0 {
+			t.Errorf("%s of zero: published %q", tc.name, got)
+		}
+		if n := invalidFrames.Load() - invalid; n != 1 || fc.failures != 1 {
+			t.Errorf("%s of zero: counted %d invalid, %d failures; want 1 and 1", tc.name, n, fc.failures)
+		}
+	}
+}
+
+// profileFrame is a ProfileData frame carrying periods hourly readings of
+// 0.5 kWh, which runs to several kilobytes.
+func profileFrame(periods int) string {
+	values := make([]string, periods)
+	for i := range values {
+		values[i] = "0x000001f4"
+	}
+	return "<ProfileData>\r\n" +
+		"  <DeviceMacId>0xd8d5b9000000abcd</DeviceMacId>\r\n" +
+		"  <MeterMacId>0x00135003000abcde</MeterMacId>\r\n" +
+		"  <EndTime>0x2c3a1b00</EndTime>\r\n" +
+		"  <Status>0x00</Status>\r\n" +
+		"  <ProfileIntervalPeriod>0x01</ProfileIntervalPeriod>\r\n" +
+		fmt.Sprintf("  <NumberOfPeriodsDelivered>0x%02x</NumberOfPeriodsDelivered>\r\n", periods) +
+		"  <IntervalData>" + strings.Join(values, ",") + "</IntervalData>\r\n" +
+		"  <Multiplier>0x00000001</Multiplier>\r\n" +
+		"  <Divisor>0x000003e8</Divisor>\r\n" +
+		"</ProfileData>\r\n"
+}
+
+func TestScanSerialLargeFrame(t *testing.T) {
+	profile := profileFrame(2000)
+	for _, size := range []int{64, 4096} {
+		_, rec := testFrameContext(t)
+		viper.Set("SERIAL_IDLE_TIMEOUT", 0)
+		viper.Set("SERIAL_BUFFER_BYTES", size)
+		if len(profile) <= size {
+			t.Fatalf("profile frame of %d bytes fits the %d byte buffer", len(profile), size)
+		}
+
+		err := scanSerial(context.Background(), primaryDevice(), chunkReader{strings.NewReader(demandFrame + profile + summationFrame), 1000}, rec)
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("buffer of %d: scanSerial = %v, want io.EOF", size, err)
+		}
+		payload, ok := rec.last(stateTopic("meter_profile_data"))
+		if !ok {
+			t.Fatalf("buffer of %d: %d byte ProfileData not decoded", size, len(profile))
+		}
+		var intervals []profileInterval
+		if err := json.Unmarshal([]byte(payload), &intervals); err != nil || len(intervals) != 2000 {
+			t.Errorf("buffer of %d: decoded %d intervals (%v), want 2000", size, len(intervals), err)
+		}
+		if got, _ := rec.last(stateTopic("meter_total_energy_delivered")); got != "12345.678" {
+			t.Errorf("buffer of %d: frame after the large one gave %q", size, got)
+		}
+	}
+}
+
+func TestScanSerialMixedStream(t *testing.T) {
+	_, rec := testFrameContext(t)
+	viper.Set("SERIAL_IDLE_TIMEOUT", 0)
+	useFakeClock(t, time.Date(2023, 7, 7, 0, 38, 24, 0, time.UTC))
+
+	corrupt := strings.Replace(demandFrame, "<Demand>0x0004d2</Demand>", "<Demand>0xZZZZ</Demand>", 1)
+	corrupt = strings.Replace(corrupt, "0x2c3a1b00", "0x2c3a1b04", 1)
+	later := strings.Replace(strings.Replace(demandFrame, "0x0004d2", "0x000100", 1), "0x2c3a1b00", "0x2c3a1b08", 1)
+	split := len(later) / 2
+	stream := io.MultiReader(
+		strings.NewReader("\x00\xfe\r\n"+demandFrame+
+			// The dongle reset partway through a frame.
+			"<InstantaneousDemand>\r\n  <DeviceMacId>0xd8d5"+
+			summationFrame+corrupt+timeFrame+later[:split]),
+		strings.NewReader(later[split:]+"<CurrentSummationDelivered>\r\n  <Device"),
+	)
+
+	err := scanSerial(context.Background(), primaryDevice(), stream, rec)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("scanSerial = %v, want io.EOF", err)
+	}
+	want := []string{
+		"homeassistant/sensor/meter_power_demand/state=1234",
+		"homeassistant/sensor/meter_total_energy_delivered/state=12345.678",
+		"homeassistant/sensor/meter_total_energy_received/state=0.000",
+		"homeassistant/sensor/meter_net_energy/state=12345.678",
+		"homeassistant/sensor/meter_clock/state=2023-07-07T00:38:24Z",
+		"homeassistant/sensor/meter_clock_drift/state=0",
+		"homeassistant/sensor/meter_power_demand/state=256",
+	}
+	if got := rec.states(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInvalidSentinelFields(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	demand := strings.Replace(demandFrame, "<Demand>0x0004d2</Demand>", "<Demand>0xFFFFFF</Demand>", 1)
+	summation := strings.Replace(summationFrame, "<SummationReceived>0x0000000000000000</SummationReceived>", "<SummationReceived>0xffffffffffff</SummationReceived>", 1)
+	invalid := invalidFrames.Load()
+
+	dispatchFrame(fc, []byte(demand))
+	dispatchFrame(fc, []byte(summation))
+
+	// Net energy carries the last known received total, none yet, forward.
+	want := []string{
+		stateTopic("meter_total_energy_delivered") + "=12345.678",
+		stateTopic("meter_net_energy") + "=12345.678",
+	}
+	if got := rec.states(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published %q, want %q", got, want)
+	}
+	if n := invalidFrames.Load() - invalid; n != 0 {
+		t.Errorf("sentinels counted as %d invalid frames", n)
+	}
+}
+
+func TestFormatSummationMatchesDisplay(t *testing.T) {
+	// Each case is a summation frame and what the EMU-2 showed for it.
+	tests := []struct {
+		name, summation, right, left, suppress string
+		display                                string
+	}{
+		{"suppressed", "0x0000000000bc614e", "0x03", "0x06", "Y", "12345.678"},
+		{"zero padded", "0x0000000000bc614e", "0x03", "0x06", "N", "012345.678"},
+		{"one decimal", "0x000000000001e240", "0x01", "0x05", "N", "00123.5"},
+		{"no decimals", "0x000000000001e240", "0x00", "0x05", "Y", "123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := strings.NewReplacer(
+				"0x0000000000bc614e", tt.summation,
+				"<DigitsRight>0x03", "<DigitsRight>"+tt.right,
+				"<DigitsLeft>0x06", "<DigitsLeft>"+tt.left,
+				"<SuppressLeadingZero>Y", "<SuppressLeadingZero>"+tt.suppress,
+			).Replace(summationFrame)
+			for _, format := range []string{"meter", "fixed"} {
+				fc, rec := testFrameContext(t)
+				viper.Set("ENERGY_FORMAT", format)
+				dispatchFrame(fc, []byte(frame))
+
+				want := tt.display
+				if format == "fixed" {
+					want = formatEnergy(float64(mustParseHex(t, tt.summation)) / 1000)
+				}
+				if got, _ := rec.last(stateTopic("meter_total_energy_delivered")); got != want {
+					t.Errorf("ENERGY_FORMAT %s published %q, want %q", format, got, want)
+				}
+			}
+		})
+	}
+}
+
+func mustParseHex(t *testing.T, s string) int64 {
+	t.Helper()
+	v, err := parseHex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSolarExportSummation(t *testing.T) {
+	tests := []struct {
+		name, delivered, received string
+		want                      [3]string
+	}{
+		{"net exporter", "0x00000000000a1b2c", "0x0000000000c35000", [3]string{"662.316", "12800.000", "-12137.684"}},
+		// Received is past what an int32 holds; only the full 48 bits
+		// decode it.
+		{"beyond 32 bits", "0x00000000000a1b2c", "0x00000001000003e8", [3]string{"662.316", "4294968.296", "-4294305.980"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, rec := testFrameContext(t)
+			frame := strings.NewReplacer(
+				"0x0000000000bc614e", tt.delivered,
+				"<SummationReceived>0x0000000000000000", "<SummationReceived>"+tt.received,
+			).Replace(summationFrame)
+			dispatchFrame(fc, []byte(frame))
+			want := []string{
+				stateTopic("meter_total_energy_delivered") + "=" + tt.want[0],
+				stateTopic("meter_total_energy_received") + "=" + tt.want[1],
+				stateTopic("meter_net_energy") + "=" + tt.want[2],
+			}
+			if got := rec.states(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("published %q, want %q", got, want)
+			}
+		})
+	}
+}
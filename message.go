@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Message has no XMLName: the EMU-2 sends <MessageCluster>, but other
+// firmware names the element <Message>.
+type Message struct {
+	DeviceMacId          string `xml:"DeviceMacId"`
+	MeterMacId           string `xml:"MeterMacId"`
+	TimeStamp            string `xml:"TimeStamp"`
+	Id                   string `xml:"Id" validate:"required"`
+	Text                 string `xml:"Text"`
+	Priority             string `xml:"Priority"`
+	ConfirmationRequired string `xml:"ConfirmationRequired"`
+	Confirmed            string `xml:"Confirmed"`
+	Queue                string `xml:"Queue"`
+}
+
+// Home Assistant rejects sensor states longer than this.
+const maxStateLength = 255
+
+var (
+	messageMu     sync.Mutex
+	lastMessageID string
+)
+
+// decodeMessageText hex-decodes a message's Text; firmware that sends plain
+// text is passed through unchanged.
+func decodeMessageText(s string) string {
+	s = strings.TrimSpace(s)
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// handleMessage publishes utility text notices. The EMU-2 repeats the
+// active message, so only a new Id is published.
+func handleMessage(fc *frameContext, data []byte) {
+	var message Message
+	if err := fc.decode(data, &message); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if !fc.dev.primary() {
+		return
+	}
+
+	messageMu.Lock()
+	seen := message.Id == lastMessageID
+	lastMessageID = message.Id
+	messageMu.Unlock()
+	if seen {
+		return
+	}
+
+	text := decodeMessageText(message.Text)
+	log.Printf("Utility message %s: %s", message.Id, text)
+	attrs := map[string]interface{}{
+		"id":                    message.Id,
+		"priority":              message.Priority,
+		"confirmation_required": message.ConfirmationRequired == "Y",
+		"timestamp":             formatTimestamp(reportedTime(message.TimeStamp)),
+		"text":                  text,
+	}
+	b, _ := json.Marshal(attrs)
+	fc.m.Publish(attributesTopic("meter_message"), 0, true, b)
+	if r := []rune(text); len(r) > maxStateLength {
+		text = string(r[:maxStateLength])
+	}
+	fc.m.Publish(stateTopic("meter_message"), 0, true, text)
+}
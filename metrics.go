@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+)
+
+var (
+	powerDemandGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emu2_power_demand_watts",
+		Help: "Instantaneous demand reported by the meter.",
+	}, []string{"device"})
+	energyDeliveredGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emu2_energy_delivered_kwh",
+		Help: "Total energy delivered from the grid.",
+	}, []string{"device"})
+	energyReceivedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emu2_energy_received_kwh",
+		Help: "Total energy exported to the grid.",
+	}, []string{"device"})
+	parseErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "emu2_parse_errors_total",
+		Help: "Frames that could not be decoded.",
+	}, []string{"device"})
+	serialConnectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emu2_serial_connected",
+		Help: "Whether the EMU-2 serial port is open (1) or not (0).",
+	}, []string{"device"})
+)
+
+// serveMetrics exposes the readings for Prometheus on METRICS_ADDR. The
+// gauges are updated regardless; without an address nothing is served.
+func serveMetrics() {
+	addr := viper.GetString("METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(powerDemandGauge, energyDeliveredGauge, energyReceivedGauge, parseErrorsCounter, serialConnectedGauge, publishDroppedCounter)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		log.Print("Serving metrics on ", addr)
+		log.Print("Metrics server stopped: ", http.ListenAndServe(addr, mux))
+	}()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/spf13/viper"
+)
+
+// serveBroker accepts one MQTT client on l and sends each message it
+// publishes to received as "topic=payload".
+func serveBroker(t *testing.T, l net.Listener, received chan<- string) {
+	t.Helper()
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			received <- p.TopicName + "=" + string(p.Payload)
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			}
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestReadingsWaitForLateBroker(t *testing.T) {
+	resetBridge(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback networking: ", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	host, port, _ := net.SplitHostPort(addr)
+	viper.Set("MQTT_HOST", host)
+	viper.Set("MQTT_PORT", port)
+	viper.Set("MQTT_RETRY_INTERVAL", 50*time.Millisecond)
+	viper.Set("SERIAL_IDLE_TIMEOUT", 0)
+	t.Cleanup(func() {
+		health.mqttConnected.Store(false)
+		connectHooksMu.Lock()
+		connectHooks = nil
+		connectHooksMu.Unlock()
+	})
+
+	client := connectMQTT()
+	defer client.Disconnect(0)
+	m := queuePublishes(client)
+
+	// The broker is down: the frames are still read and decoded.
+	done := make(chan error)
+	go func() {
+		done <- scanSerial(context.Background(), primaryDevice(), strings.NewReader(demandFrame+summationFrame), m)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("scanSerial = %v, want io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serial reader blocked while the broker was down")
+	}
+	if delivered, _ := state.summation(); delivered != 12345.678 {
+		t.Errorf("delivered while the broker was down = %v, want 12345.678", delivered)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not reuse the broker port: ", err)
+	}
+	defer l.Close()
+	received := make(chan string, 100)
+	go serveBroker(t, l, received)
+
+	want := map[string]bool{
+		stateTopic("meter_power_demand") + "=1234":                true,
+		stateTopic("meter_total_energy_delivered") + "=12345.678": true,
+	}
+	timeout := time.After(10 * time.Second)
+	for len(want) > 0 {
+		select {
+		case msg := <-received:
+			delete(want, msg)
+		case <-timeout:
+			t.Fatalf("queued readings never reached the broker: %v", want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// persistedState is written to STATE_FILE so derived values survive a
+// restart.
+type persistedState struct {
+	DemandPeakWatts    float64   `json:"demand_peak_watts"`
+	DemandPeakTime     time.Time `json:"demand_peak_time"`
+	BillingPeriodStart time.Time `json:"billing_period_start"`
+	CostTotal          float64   `json:"cost_total"`
+	CostBaselineKWh    float64   `json:"cost_baseline_kwh"`
+	CostBaselineSet    bool      `json:"cost_baseline_set"`
+	HourStart          time.Time `json:"hour_start"`
+	HourEnergyKWh      float64   `json:"hour_energy_kwh"`
+	PreviousHourKWh    float64   `json:"previous_hour_kwh"`
+	HourBaselineKWh    float64   `json:"hour_baseline_kwh"`
+	HourBaselineSet    bool      `json:"hour_baseline_set"`
+	DayStart           time.Time `json:"day_start"`
+	DayEnergyKWh       float64   `json:"day_energy_kwh"`
+	PreviousDayKWh     float64   `json:"previous_day_kwh"`
+	DayBaselineKWh     float64   `json:"day_baseline_kwh"`
+	DayBaselineSet     bool      `json:"day_baseline_set"`
+	DeliveredKWh       float64   `json:"delivered_kwh"`
+	ReceivedKWh        float64   `json:"received_kwh"`
+	SummationSet       bool      `json:"summation_set"`
+	DemandWatts        int       `json:"demand_watts"`
+	DemandSet          bool      `json:"demand_set"`
+}
+
+var (
+	persistMu sync.Mutex
+	persisted persistedState
+
+	// stateDirty is set when readings changed since the last save, and
+	// liveSummation and liveDemand once that reading has arrived from the
+	// meter since startup, after which the restored one is stale.
+	stateDirty    bool
+	liveSummation bool
+	liveDemand    bool
+)
+
+func loadState() {
+	path := viper.GetString("STATE_FILE")
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Print("Failed reading state file: ", err)
+		return
+	}
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	if err := json.Unmarshal(b, &persisted); err != nil {
+		log.Print("Ignoring corrupt state file ", path, ": ", err)
+		persisted = persistedState{}
+		return
+	}
+	if persisted.SummationSet {
+		state.seed(&persisted.DeliveredKWh, &persisted.ReceivedKWh)
+	}
+}
+
+// rememberSummation and rememberDemand record the primary device's latest
+// readings. They reach STATE_FILE only through the periodic save, so a meter
+// reporting every few seconds does not wear out an SD card.
+func rememberSummation(delivered, received float64) {
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	persisted.DeliveredKWh, persisted.ReceivedKWh, persisted.SummationSet = delivered, received, true
+	stateDirty = true
+	liveSummation = true
+}
+
+func rememberDemand(watts int) {
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	persisted.DemandWatts, persisted.DemandSet = watts, true
+	stateDirty = true
+	liveDemand = true
+}
+
+// savePeriodically writes remembered readings every STATE_SAVE_INTERVAL,
+// and once more when ctx is cancelled.
+func savePeriodically(ctx context.Context) {
+	interval := viper.GetDuration("STATE_SAVE_INTERVAL")
+	if viper.GetString("STATE_FILE") == "" || interval <= 0 {
+		return
+	}
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushState()
+			return
+		case <-ticker.C():
+			flushState()
+		}
+	}
+}
+
+func flushState() {
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	if stateDirty {
+		saveState()
+	}
+}
+
+// republishState publishes the restored energy totals with STATE_REPUBLISH,
+// so Home Assistant has them before the meter's next summation, and the
+// restored demand too when RETAIN_DEMAND keeps it on the broker. Each is
+// skipped once the meter has sent a live one.
+func republishState(m Publisher) {
+	if !viper.GetBool("STATE_REPUBLISH") {
+		return
+	}
+	persistMu.Lock()
+	restored := persisted.SummationSet && !liveSummation
+	delivered, received := persisted.DeliveredKWh, persisted.ReceivedKWh
+	restoredDemand := persisted.DemandSet && !liveDemand
+	watts := persisted.DemandWatts
+	persistMu.Unlock()
+	if restored {
+		log.Printf("Republishing restored summation: delivered %.3f, received %.3f", delivered, received)
+		publishEnergy(m, primaryDevice(), delivered, received)
+	}
+	if restoredDemand && viper.GetBool("RETAIN_DEMAND") && !sparkplugEnabled() {
+		log.Printf("Republishing restored demand: %d W", watts)
+		dev := primaryDevice()
+		if jsonPublishMode() {
+			dev.combined.update(m, dev, map[string]string{"demand": formatDemand(watts)})
+			return
+		}
+		publishState(m, stateTopic(dev.id("power_demand")), true, formatDemand(watts))
+	}
+}
+
+// saveState writes the state atomically: a temp file in the same directory
+// is renamed over the old one, so a power cut never leaves a torn file.
+// Callers must hold persistMu.
+func saveState() {
+	path := viper.GetString("STATE_FILE")
+	if path == "" {
+		return
+	}
+	stateDirty = false
+	b, err := json.Marshal(persisted)
+	if err != nil {
+		log.Print("Failed encoding state: ", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		log.Print("Failed writing state file: ", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		log.Print("Failed writing state file: ", err)
+		return
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		log.Print("Failed writing state file: ", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		log.Print("Failed writing state file: ", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Print("Failed writing state file: ", err)
+	}
+}
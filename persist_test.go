@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAccumulatorsLeaveSavingToFlush(t *testing.T) {
+	_, rec := testFrameContext(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+	viper.Set("STATE_FILE", path)
+	viper.Set("FLAT_RATE", 0.25)
+	viper.Set("DAILY_ENERGY", true)
+	viper.Set("HOURLY_ENERGY", true)
+	t.Cleanup(func() {
+		persistMu.Lock()
+		persisted, stateDirty = persistedState{}, false
+		persistMu.Unlock()
+	})
+
+	for _, kwh := range []float64{100, 102} {
+		accumulateCost(rec, kwh)
+		updateDailyEnergy(rec, kwh, "0x2c3a1b00")
+		updateHourlyEnergy(rec, kwh, "0x2c3a1b00")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file written on every summation: %v", err)
+	}
+	if !stateDirty {
+		t.Fatal("state not marked dirty")
+	}
+
+	flushState()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved persistedState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.CostTotal != 0.5 || saved.DayEnergyKWh != 2 || saved.HourEnergyKWh != 2 {
+		t.Errorf("saved cost %v, day %v kWh, hour %v kWh; want 0.5, 2, 2", saved.CostTotal, saved.DayEnergyKWh, saved.HourEnergyKWh)
+	}
+}
+
+func TestRepublishRestoredDemand(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		retainDemand bool
+		live         bool
+		want         string
+	}{
+		{"retained", true, false, "1234"},
+		{"not retained", false, false, ""},
+		{"live demand seen", true, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, rec := testFrameContext(t)
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(`{"demand_watts": 1234, "demand_set": true}`), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			viper.Set("STATE_FILE", path)
+			viper.Set("STATE_REPUBLISH", true)
+			viper.Set("RETAIN_DEMAND", tc.retainDemand)
+			loadState()
+			if tc.live {
+				liveDemand = true
+			}
+
+			republishState(rec)
+			if got, _ := rec.last(stateTopic("meter_power_demand")); got != tc.want {
+				t.Errorf("republished demand %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type PriceCluster struct {
+	XMLName           xml.Name `xml:"PriceCluster"`
+	DeviceMacId       string   `xml:"DeviceMacId"`
+	MeterMacId        string   `xml:"MeterMacId"`
+	TimeStamp         string   `xml:"TimeStamp"`
+	Price             string   `xml:"Price" validate:"required,emuhex"`
+	Currency          string   `xml:"Currency"`
+	TrailingDigits    string   `xml:"TrailingDigits" validate:"required,emuhex"`
+	Tier              string   `xml:"Tier"`
+	StartTime         string   `xml:"StartTime"`
+	Duration          string   `xml:"Duration"`
+	DurationInMinutes string   `xml:"DurationInMinutes"`
+	RateLabel         string   `xml:"RateLabel"`
+}
+
+// currencyCodes maps the ISO 4217 numeric codes the meter sends to their
+// alphabetic codes, which Home Assistant expects as the unit.
+var currencyCodes = map[int64]string{
+	36:  "AUD",
+	124: "CAD",
+	208: "DKK",
+	392: "JPY",
+	484: "MXN",
+	554: "NZD",
+	578: "NOK",
+	752: "SEK",
+	756: "CHF",
+	826: "GBP",
+	840: "USD",
+	978: "EUR",
+}
+
+var (
+	currencyMu    sync.Mutex
+	meterCurrency string
+)
+
+// priceTier is the Tier of the meter's latest PriceCluster, 0 until one
+// carries it. It picks the tier's prices out of a BlockPriceDetail.
+var priceTier atomic.Int64
+
+// currency is the alphabetic currency code of the meter's prices: the one
+// broadcast by the meter once a price has been seen, otherwise CURRENCY.
+func currency() string {
+	currencyMu.Lock()
+	defer currencyMu.Unlock()
+	if meterCurrency != "" {
+		return meterCurrency
+	}
+	return viper.GetString("CURRENCY")
+}
+
+// setCurrency records the currency of a PriceCluster and reports whether it
+// changed the unit advertised in discovery.
+func setCurrency(field string) bool {
+	if field == "" {
+		return false
+	}
+	n, err := parseHex(field)
+	if err != nil {
+		log.Print("Ignoring invalid currency: ", err)
+		return false
+	}
+	code, ok := currencyCodes[n]
+	if !ok {
+		log.Printf("Unknown ISO 4217 currency %d", n)
+		return false
+	}
+	before := currency()
+	currencyMu.Lock()
+	meterCurrency = code
+	currencyMu.Unlock()
+	return code != before
+}
+
+// A duration of 0xFFFF means the price stays in effect until changed.
+const priceUntilChanged = 0xFFFF
+
+// priceValidUntil returns the end of the price period, or nil when the
+// price has no scheduled expiry.
+func priceValidUntil(p PriceCluster) (*time.Time, error) {
+	duration := p.DurationInMinutes
+	if duration == "" {
+		duration = p.Duration
+	}
+	if duration == "" {
+		return nil, nil
+	}
+	minutes, err := parseHex(duration)
+	if err != nil {
+		return nil, err
+	}
+	if minutes == priceUntilChanged {
+		return nil, nil
+	}
+
+	// A zero or missing StartTime means the price started "now", i.e. when
+	// the frame was generated.
+	start, err := parseEmuTimestamp(p.StartTime)
+	if err != nil || start.Unix() == emuEpochOffset {
+		if start, err = parseEmuTimestamp(p.TimeStamp); err != nil {
+			return nil, err
+		}
+	}
+	until := start.Add(time.Duration(minutes) * time.Minute)
+	return &until, nil
+}
+
+func handlePriceCluster(fc *frameContext, data []byte) {
+	var priceCluster PriceCluster
+	if err := fc.decode(data, &priceCluster); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if fc.dev.primary() {
+		publishPrice(fc.m, priceCluster)
+	}
+}
+
+func publishPrice(m Publisher, p PriceCluster) {
+	price, err := parseHex(p.Price)
+	if err != nil {
+		slog.Warn("Skipping malformed frame", "frame", "PriceCluster", "err", err)
+		return
+	}
+	digits, err := parseHex(p.TrailingDigits)
+	if err != nil {
+		slog.Warn("Skipping malformed frame", "frame", "PriceCluster", "err", err)
+		return
+	}
+	if price == 0 {
+		slog.Warn("Skipping PriceCluster without a price")
+		return
+	}
+	value := float64(price) / math.Pow10(int(digits))
+	if p.Tier != "" {
+		if tier, err := parseHex(p.Tier); err == nil {
+			priceTier.Store(tier)
+		} else {
+			log.Print("Ignoring invalid price tier: ", err)
+		}
+	}
+
+	if setCurrency(p.Currency) && !sparkplugEnabled() {
+		setupMQTTDiscovery(m)
+	}
+	attrs := map[string]interface{}{"price_valid_until": nil, "rate_label": p.RateLabel}
+	until, err := priceValidUntil(p)
+	if err != nil {
+		log.Print("Ignoring invalid price duration: ", err)
+	} else if until != nil {
+		attrs["price_valid_until"] = formatTimestamp(*until)
+	}
+	b, _ := json.Marshal(attrs)
+
+	setMeterPrice(value)
+	costRate.publish(m)
+	slog.Debug("Publishing price", "price", value, "topic", stateTopic("meter_price"))
+	publishReading(map[string]interface{}{"price": value})
+	if sparkplugEnabled() {
+		sparkplug.data(m, map[string]string{"Price": strconv.FormatFloat(value, 'f', -1, 64)})
+		return
+	}
+	m.Publish(attributesTopic("meter_price"), 0, true, b)
+	m.Publish(stateTopic("meter_price"), 0, false, strconv.FormatFloat(value, 'f', int(digits), 64))
+}
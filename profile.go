@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ProfileData answers get_profile_data with a block of historical interval
+// readings, most recent first. The meter does not send a Multiplier and
+// Divisor with every block; without them the scale of the latest summation
+// applies.
+type ProfileData struct {
+	XMLName                  xml.Name `xml:"ProfileData"`
+	DeviceMacId              string   `xml:"DeviceMacId"`
+	MeterMacId               string   `xml:"MeterMacId"`
+	EndTime                  string   `xml:"EndTime" validate:"required,emuhex"`
+	Status                   string   `xml:"Status"`
+	ProfileIntervalPeriod    string   `xml:"ProfileIntervalPeriod" validate:"required,emuhex"`
+	NumberOfPeriodsDelivered string   `xml:"NumberOfPeriodsDelivered" validate:"required,emuhex"`
+	IntervalData             string   `xml:"IntervalData"`
+	Multiplier               string   `xml:"Multiplier" validate:"omitempty,emuhex"`
+	Divisor                  string   `xml:"Divisor" validate:"omitempty,emuhex"`
+}
+
+// Zigbee SE ProfileIntervalPeriod values.
+var profileIntervals = []time.Duration{
+	24 * time.Hour,
+	60 * time.Minute,
+	30 * time.Minute,
+	15 * time.Minute,
+	10 * time.Minute,
+	7*time.Minute + 30*time.Second,
+	5 * time.Minute,
+	2*time.Minute + 30*time.Second,
+}
+
+type profileInterval struct {
+	End string  `json:"end"`
+	KWh float64 `json:"kwh"`
+}
+
+// handleProfileData publishes the intervals as a JSON array on the
+// meter_profile_data topic, oldest first, for backfilling statistics.
+func handleProfileData(fc *frameContext, data []byte) {
+	var profile ProfileData
+	if err := fc.decode(data, &profile); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	intervals, err := decodeProfile(profile, fc.dev.state)
+	if err != nil {
+		fc.malformed("ProfileData", err)
+		return
+	}
+	b, _ := json.Marshal(intervals)
+	fc.m.Publish(stateTopic(fc.dev.id("profile_data")), 0, false, b)
+}
+
+func decodeProfile(p ProfileData, s *meterState) ([]profileInterval, error) {
+	end, err := parseEmuTimestamp(p.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	period, err := parseHex(p.ProfileIntervalPeriod)
+	if err != nil {
+		return nil, err
+	}
+	if period < 0 || period >= int64(len(profileIntervals)) {
+		return nil, fmt.Errorf("unknown interval period %d", period)
+	}
+	count, err := parseHex(p.NumberOfPeriodsDelivered)
+	if err != nil {
+		return nil, err
+	}
+
+	var mult, div float64
+	if p.Multiplier != "" || p.Divisor != "" {
+		if mult, div, err = parseScale(p.Multiplier, p.Divisor); err != nil {
+			return nil, err
+		}
+	} else if mult, div = s.scale(); div == 0 {
+		return nil, fmt.Errorf("no multiplier or divisor known yet")
+	}
+
+	values := strings.FieldsFunc(p.IntervalData, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n' })
+	if int64(len(values)) != count {
+		slog.Warn("ProfileData period count does not match its data", "periods", count, "values", len(values))
+		if int64(len(values)) > count {
+			values = values[:count]
+		}
+	}
+
+	step := profileIntervals[period]
+	intervals := make([]profileInterval, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		if allOnes(values[i]) {
+			continue
+		}
+		v, err := parseHex(values[i])
+		if err != nil {
+			return nil, err
+		}
+		intervals = append(intervals, profileInterval{
+			End: formatTimestamp(end.Add(-time.Duration(i) * step)),
+			KWh: float64(v) * mult / div,
+		})
+	}
+	return intervals, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// Publisher is the part of the MQTT client the readings are sent through.
+// An mqtt.Client satisfies it, as does the DRY_RUN stub.
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+}
+
+// stateQoS is MQTT_QOS, the QoS readings are published at.
+func stateQoS() byte {
+	return byte(viper.GetInt("MQTT_QOS"))
+}
+
+// publishState publishes a reading at MQTT_QOS. Above QoS 0 the delivery is
+// confirmed in the background, so a slow broker never stalls the scan loop;
+// failures and timeouts are logged.
+func publishState(m Publisher, topic string, retained bool, payload interface{}) {
+	if duplicates.suppress(topic, payload) {
+		return
+	}
+	qos := stateQoS()
+	token := m.Publish(topic, qos, retained, payload)
+	if qos == 0 {
+		return
+	}
+	go func() {
+		if !token.WaitTimeout(viper.GetDuration("MQTT_PUBLISH_TIMEOUT")) {
+			slog.Warn("Publish not acknowledged in time", "topic", topic, "qos", qos)
+			return
+		}
+		if err := token.Error(); err != nil {
+			slog.Warn("Publish failed", "topic", topic, "err", err)
+		}
+	}()
+}
+
+// duplicateFilter implements SUPPRESS_DUPLICATES: a reading equal to the
+// last one published to its topic is skipped, so the recorder does not
+// store the same demand over and over. It is sent anyway once
+// SUPPRESS_DUPLICATES_HEARTBEAT has passed since the last publish, if set.
+type duplicateFilter struct {
+	mu     sync.Mutex
+	topics map[string]publishedValue
+}
+
+type publishedValue struct {
+	payload string
+	at      time.Time
+}
+
+var duplicates duplicateFilter
+
+func (d *duplicateFilter) suppress(topic string, payload interface{}) bool {
+	if !viper.GetBool("SUPPRESS_DUPLICATES") {
+		return false
+	}
+	value := fmt.Sprint(payload)
+	if b, ok := payload.([]byte); ok {
+		value = string(b)
+	}
+	now := clock.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.topics == nil {
+		d.topics = map[string]publishedValue{}
+	}
+	last, ok := d.topics[topic]
+	heartbeat := viper.GetDuration("SUPPRESS_DUPLICATES_HEARTBEAT")
+	if ok && last.payload == value && (heartbeat <= 0 || now.Sub(last.at) < heartbeat) {
+		return true
+	}
+	d.topics[topic] = publishedValue{payload: value, at: now}
+	return false
+}
+
+// dryRunPublisher prints every publish to stdout instead of sending it, for
+// trying out a configuration without a broker.
+type dryRunPublisher struct{}
+
+func (dryRunPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if b, ok := payload.([]byte); ok {
+		payload = string(b)
+	}
+	fmt.Printf("%s qos=%d retain=%t %v\n", topic, qos, retained, payload)
+	return &mqtt.DummyToken{}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestSuppressDuplicatesHeartbeat(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	viper.Set("SUPPRESS_DUPLICATES", true)
+	viper.Set("SUPPRESS_DUPLICATES_HEARTBEAT", time.Minute)
+	// 0x2c3a1b00 is 2023-07-07T00:38:24Z.
+	c := useFakeClock(t, time.Date(2023, 7, 7, 0, 38, 24, 0, time.UTC))
+
+	// Each step is seconds since the previous frame and the demand sent;
+	// the timestamp moves on with the clock so the frames are not
+	// dropped as retransmissions.
+	steps := []struct {
+		after  int
+		demand string
+	}{
+		{0, "0x0004d2"},
+		{10, "0x0004d2"},
+		{10, "0x000514"},
+		{10, "0x000514"},
+		{40, "0x000514"}, // 50s since 1300 was published
+		{10, "0x000514"}, // a minute: heartbeat
+		{10, "0x000514"},
+	}
+	stamp := int64(0x2c3a1b00)
+	for _, s := range steps {
+		c.advance(time.Duration(s.after) * time.Second)
+		stamp += int64(s.after)
+		frame := strings.NewReplacer(
+			"0x2c3a1b00", fmt.Sprintf("0x%08x", stamp),
+			"0x0004d2", s.demand,
+		).Replace(demandFrame)
+		dispatchFrame(fc, []byte(frame))
+	}
+
+	topic := stateTopic("meter_power_demand")
+	want := []string{topic + "=1234", topic + "=1300", topic + "=1300"}
+	if got := rec.states(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published %q, want %q", got, want)
+	}
+}
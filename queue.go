@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var publishDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "emu2_publish_dropped_total",
+	Help: "Publishes dropped because the publish queue was full.",
+})
+
+var errPublishDropped = errors.New("dropped from a full publish queue")
+
+// publishQueue hands publishes to the MQTT client from its own goroutine, so
+// a slow broker never blocks the serial reader. The queue holds
+// PUBLISH_QUEUE_DEPTH messages; when it is full the oldest is dropped to
+// make room, since a newer reading supersedes it.
+type publishQueue struct {
+	next Publisher
+	ch   chan *queuedPublish
+
+	// up is closed once the broker has first connected. Until then
+	// messages wait in the queue, as the client would discard them.
+	up     chan struct{}
+	upOnce sync.Once
+
+	// dropping is set from the first drop until the queue empties again,
+	// so a backlog is logged once rather than per message.
+	dropping atomic.Bool
+}
+
+type queuedPublish struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  interface{}
+	token    *queuedToken
+}
+
+func newPublishQueue(next Publisher, depth int) *publishQueue {
+	q := &publishQueue{next: next, ch: make(chan *queuedPublish, depth), up: make(chan struct{})}
+	go q.drain()
+	return q
+}
+
+// connected starts sending the queued messages.
+func (q *publishQueue) connected() {
+	q.upOnce.Do(func() { close(q.up) })
+}
+
+func (q *publishQueue) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p := &queuedPublish{topic, qos, retained, payload, &queuedToken{sent: make(chan struct{})}}
+	for {
+		select {
+		case q.ch <- p:
+			return p.token
+		default:
+		}
+		select {
+		case old := <-q.ch:
+			publishDroppedCounter.Inc()
+			if !q.dropping.Swap(true) {
+				slog.Warn("Publish queue full, dropping oldest messages", "topic", old.topic)
+			}
+			old.token.finish(nil, errPublishDropped)
+		default:
+		}
+	}
+}
+
+func (q *publishQueue) drain() {
+	<-q.up
+	for p := range q.ch {
+		p.token.finish(q.next.Publish(p.topic, p.qos, p.retained, p.payload), nil)
+		if len(q.ch) == 0 && q.dropping.Swap(false) {
+			slog.Info("Publish queue caught up")
+		}
+	}
+}
+
+// queuedToken completes once the message has left the queue and, if it was
+// sent, once the client's own token has.
+type queuedToken struct {
+	sent  chan struct{}
+	inner mqtt.Token
+	err   error
+}
+
+func (t *queuedToken) finish(inner mqtt.Token, err error) {
+	t.inner, t.err = inner, err
+	close(t.sent)
+}
+
+func (t *queuedToken) Wait() bool {
+	<-t.sent
+	return t.inner == nil || t.inner.Wait()
+}
+
+func (t *queuedToken) WaitTimeout(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	select {
+	case <-t.sent:
+	case <-time.After(d):
+		return false
+	}
+	return t.inner == nil || t.inner.WaitTimeout(time.Until(deadline))
+}
+
+func (t *queuedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		<-t.sent
+		if t.inner != nil {
+			<-t.inner.Done()
+		}
+		close(done)
+	}()
+	return done
+}
+
+func (t *queuedToken) Error() error {
+	select {
+	case <-t.sent:
+	default:
+		return nil
+	}
+	if t.err != nil || t.inner == nil {
+		return t.err
+	}
+	return t.inner.Error()
+}
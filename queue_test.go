@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowPublisher is a broker that takes a publish and then stalls until
+// released.
+type slowPublisher struct {
+	recordingPublisher
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	s.started <- struct{}{}
+	<-s.release
+	return s.recordingPublisher.Publish(topic, qos, retained, payload)
+}
+
+func TestPublishQueueSlowBroker(t *testing.T) {
+	slow := &slowPublisher{started: make(chan struct{}, 10), release: make(chan struct{})}
+	q := newPublishQueue(slow, 2)
+	q.connected()
+	dropped := testutil.ToFloat64(publishDroppedCounter)
+
+	q.Publish("a", 0, false, "1")
+	<-slow.started // a is with the broker, which has stalled
+
+	tokens := map[string]mqtt.Token{}
+	done := make(chan struct{})
+	go func() {
+		for _, topic := range []string{"b", "c", "d"} {
+			tokens[topic] = q.Publish(topic, 0, false, "1")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked behind a stalled broker")
+	}
+
+	if !tokens["b"].WaitTimeout(time.Second) || !errors.Is(tokens["b"].Error(), errPublishDropped) {
+		t.Errorf("oldest message finished with %v, want errPublishDropped", tokens["b"].Error())
+	}
+	if got := testutil.ToFloat64(publishDroppedCounter) - dropped; got != 1 {
+		t.Errorf("dropped counter rose by %v, want 1", got)
+	}
+
+	close(slow.release)
+	if !tokens["d"].WaitTimeout(time.Second) {
+		t.Fatal("queue did not drain once the broker recovered")
+	}
+	var got []string
+	slow.mu.Lock()
+	for _, m := range slow.msgs {
+		got = append(got, m.topic)
+	}
+	slow.mu.Unlock()
+	if want := "a c d"; strings.Join(got, " ") != want {
+		t.Errorf("broker got %v, want %s", got, want)
+	}
+}
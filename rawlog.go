@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// rawLog appends every scanned token to RAW_LOG_FILE, each prefixed with the
+// time it was read. The prefix sits before the opening tag, where the frame
+// splitter skips it, so the file can be replayed with INPUT_SOURCE or
+// "emu2mqtt decode". Writes are buffered and flushed every second; the file
+// is rotated at RAW_LOG_MAX_MB, keeping RAW_LOG_MAX_BACKUPS old files,
+// gzipped with RAW_LOG_COMPRESS.
+type rawLog struct {
+	mu   sync.Mutex
+	file *lumberjack.Logger
+	w    *bufio.Writer
+}
+
+var raw rawLog
+
+func openRawLog() {
+	path := viper.GetString("RAW_LOG_FILE")
+	if path == "" {
+		return
+	}
+	raw.file = &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    viper.GetInt("RAW_LOG_MAX_MB"),
+		MaxBackups: viper.GetInt("RAW_LOG_MAX_BACKUPS"),
+		Compress:   viper.GetBool("RAW_LOG_COMPRESS"),
+	}
+	raw.w = bufio.NewWriterSize(raw.file, 64*1024)
+	log.Print("Logging raw frames to ", path)
+	go func() {
+		for range clock.NewTicker(time.Second).C() {
+			raw.flush()
+		}
+	}()
+}
+
+func (r *rawLog) write(token []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	r.w.WriteString(clock.Now().UTC().Format(time.RFC3339Nano))
+	r.w.WriteByte(' ')
+	r.w.Write(token)
+	r.w.WriteByte('\n')
+}
+
+func (r *rawLog) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		log.Print("Failed writing raw frame log, no longer logging raw frames: ", err)
+		r.w = nil
+	}
+}
+
+func (r *rawLog) close() {
+	r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ScheduleInfo answers get_schedule, one frame per event type.
+type ScheduleInfo struct {
+	XMLName     xml.Name `xml:"ScheduleInfo"`
+	DeviceMacId string   `xml:"DeviceMacId"`
+	MeterMacId  string   `xml:"MeterMacId"`
+	Mode        string   `xml:"Mode"`
+	Event       string   `xml:"Event" validate:"required"`
+	Frequency   string   `xml:"Frequency" validate:"required,emuhex"`
+	Enabled     string   `xml:"Enabled"`
+}
+
+type scheduledEvent struct {
+	FrequencySeconds int64 `json:"frequency_seconds"`
+	Enabled          bool  `json:"enabled"`
+}
+
+var (
+	scheduleMu sync.Mutex
+	schedule   = map[string]scheduledEvent{}
+)
+
+// handleScheduleInfo collects the EMU-2's polling schedule, so a
+// set_schedule or fast poll command can be confirmed to have taken effect.
+// The state lists each enabled event with its frequency, e.g.
+// "demand 8s, summation 240s"; the attributes hold every event.
+func handleScheduleInfo(fc *frameContext, data []byte) {
+	var info ScheduleInfo
+	if err := fc.decode(data, &info); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if !fc.dev.primary() {
+		return
+	}
+	frequency, err := parseHex(info.Frequency)
+	if err != nil {
+		fc.malformed("ScheduleInfo", err)
+		return
+	}
+
+	scheduleMu.Lock()
+	schedule[info.Event] = scheduledEvent{FrequencySeconds: frequency, Enabled: info.Enabled == "Y"}
+	events := make([]string, 0, len(schedule))
+	for event := range schedule {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	var summary []string
+	for _, event := range events {
+		if e := schedule[event]; e.Enabled {
+			summary = append(summary, fmt.Sprintf("%s %ds", event, e.FrequencySeconds))
+		}
+	}
+	b, _ := json.Marshal(schedule)
+	scheduleMu.Unlock()
+
+	text := strings.Join(summary, ", ")
+	if text == "" {
+		text = "none"
+	}
+	if r := []rune(text); len(r) > maxStateLength {
+		text = string(r[:maxStateLength])
+	}
+	fc.m.Publish(attributesTopic("meter_schedule"), 0, true, b)
+	fc.m.Publish(stateTopic("meter_schedule"), 0, true, text)
+}
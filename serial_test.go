@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tarm/serial"
+)
+
+func TestConnectSerialRetriesUntilPortAppears(t *testing.T) {
+	resetBridge(t)
+	c := useFakeClock(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.auto = true
+	viper.Set("SERIAL_OPEN_RETRY", true)
+	viper.Set("SERIAL_RETRY_MIN", time.Second)
+	viper.Set("SERIAL_RETRY_MAX", 4*time.Second)
+
+	port := &serial.Port{}
+	var opened []time.Time
+	openPort = func(*serial.Config) (*serial.Port, error) {
+		opened = append(opened, clock.Now())
+		if len(opened) <= 4 {
+			return nil, errors.New("no such file or directory")
+		}
+		return port, nil
+	}
+	t.Cleanup(func() { openPort = serial.OpenPort })
+
+	if got := connectSerial(primaryDevice()); got != port {
+		t.Fatalf("connectSerial returned %p, want the opened port", got)
+	}
+	if len(opened) != 5 {
+		t.Fatalf("port opened %d times, want 5", len(opened))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, w := range want {
+		if gap := opened[i+1].Sub(opened[i]); gap != w {
+			t.Errorf("retry %d after %v, want %v", i+1, gap, w)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2/google"
+)
+
+// A Sink receives every decoded reading as JSON, alongside the MQTT state
+// topics. Only the provider selected by CLOUD_SINK is initialized.
+type Sink interface {
+	Publish(payload []byte) error
+}
+
+// Readings are handed to the sink through a bounded queue so a slow cloud
+// endpoint never stalls the serial reader; when the queue is full the
+// reading is dropped.
+var sinkQueue chan []byte
+
+func setupSink() {
+	var sink Sink
+	var err error
+	switch provider := viper.GetString("CLOUD_SINK"); provider {
+	case "":
+		return
+	case "gcp_pubsub":
+		sink, err = newPubSubSink()
+	case "aws_iot":
+		sink, err = newAWSIoTSink()
+	default:
+		err = fmt.Errorf("unknown CLOUD_SINK %q, expected \"gcp_pubsub\" or \"aws_iot\"", provider)
+	}
+	if err != nil {
+		log.Fatal("Failed setting up cloud sink: ", err)
+	}
+
+	sinkQueue = make(chan []byte, 100)
+	go func() {
+		for payload := range sinkQueue {
+			if err := sink.Publish(payload); err != nil {
+				log.Print("Cloud sink publish failed: ", err)
+			}
+		}
+	}()
+}
+
+func publishReading(values map[string]interface{}) {
+	if sinkQueue == nil {
+		return
+	}
+	values["timestamp"] = formatTimestamp(clock.Now())
+	b, err := json.Marshal(values)
+	if err != nil {
+		log.Print("Failed encoding reading: ", err)
+		return
+	}
+	select {
+	case sinkQueue <- b:
+	default:
+		log.Print("Cloud sink queue full, dropping reading")
+	}
+}
+
+type pubSubSink struct {
+	client *http.Client
+	url    string
+}
+
+// newPubSubSink publishes through the Pub/Sub REST API using Application
+// Default Credentials (GOOGLE_APPLICATION_CREDENTIALS or the metadata
+// server), which refresh their token as needed.
+func newPubSubSink() (*pubSubSink, error) {
+	project, topic := viper.GetString("GCP_PROJECT"), viper.GetString("GCP_TOPIC")
+	if project == "" || topic == "" {
+		return nil, fmt.Errorf("GCP_PROJECT and GCP_TOPIC are required")
+	}
+	client, err := google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/pubsub")
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 30 * time.Second
+	return &pubSubSink{
+		client: client,
+		url:    fmt.Sprintf("https://pubsub.googleapis.com/v1/projects/%s/topics/%s:publish", project, topic),
+	}, nil
+}
+
+func (p *pubSubSink) Publish(payload []byte) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"messages": []map[string]string{{"data": base64.StdEncoding.EncodeToString(payload)}},
+	})
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub returned %s", resp.Status)
+	}
+	return nil
+}
+
+type awsIoTSink struct {
+	client mqtt.Client
+	topic  string
+}
+
+// newAWSIoTSink connects to AWS IoT Core's MQTT endpoint with the thing's
+// X.509 certificate; paho reconnects on its own if the link drops.
+func newAWSIoTSink() (*awsIoTSink, error) {
+	endpoint := viper.GetString("AWS_IOT_ENDPOINT")
+	if endpoint == "" {
+		return nil, fmt.Errorf("AWS_IOT_ENDPOINT is required")
+	}
+	cert, err := tls.LoadX509KeyPair(viper.GetString("AWS_IOT_CERT"), viper.GetString("AWS_IOT_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS IoT certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile := viper.GetString("AWS_IOT_CA"); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading AWS IoT CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("ssl://%s:8883", endpoint))
+	opts.SetClientID(viper.GetString("AWS_IOT_CLIENT_ID"))
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetConnectRetry(true)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Print("Lost AWS IoT connection: ", err)
+	})
+	client := mqtt.NewClient(opts)
+	client.Connect()
+
+	return &awsIoTSink{client: client, topic: viper.GetString("AWS_IOT_TOPIC")}, nil
+}
+
+func (a *awsIoTSink) Publish(payload []byte) error {
+	token := a.client.Publish(a.topic, 1, false, payload)
+	if !token.WaitTimeout(30 * time.Second) {
+		return fmt.Errorf("timed out publishing to AWS IoT")
+	}
+	return token.Error()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+const redacted = "<redacted>"
+
+var secretKeyParts = []string{"password", "token", "secret", "credential"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range secretKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		if isSecretKey(k) {
+			out[k] = redacted
+		} else if nested, ok := v.(map[string]interface{}); ok {
+			out[k] = redactSettings(nested)
+		} else if s, ok := v.(string); ok && strings.Contains(s, "://") {
+			// A URL such as MQTT_URL can carry a password.
+			out[k] = s
+			if u, err := url.Parse(s); err == nil {
+				out[k] = u.Redacted()
+			}
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// publishConfigSnapshot publishes the effective configuration, minus
+// secrets, so operators can inspect a bridge without logging into its host.
+func publishConfigSnapshot(m mqtt.Client) {
+	if !viper.GetBool("CONFIG_SNAPSHOT") {
+		return
+	}
+	b, err := json.Marshal(redactSettings(viper.AllSettings()))
+	if err != nil {
+		log.Print("Failed encoding config snapshot: ", err)
+		return
+	}
+	m.Publish(viper.GetString("CONFIG_SNAPSHOT_TOPIC"), 0, true, b)
+}
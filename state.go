@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// A summation lower than the last known value is treated as a glitch unless
+// it repeats this many times in a row, in which case the meter was reset or
+// replaced and the new value becomes the baseline.
+const summationResetConfirmations = 3
+
+type meterState struct {
+	mu            sync.Mutex
+	delivered     float64
+	received      float64
+	haveSummation bool
+	lowerReadings int
+
+	// The multiplier and divisor of the latest summation, for frames that
+	// do not carry their own.
+	mult, div float64
+
+	// How the EMU-2 displays the latest summation.
+	display summationDisplay
+}
+
+var state meterState
+
+func (s *meterState) acceptSummation(delivered, received float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.haveSummation && (delivered < s.delivered || received < s.received) {
+		s.lowerReadings++
+		if s.lowerReadings < summationResetConfirmations {
+			log.Printf("Skipping summation lower than last known value (%.3f < %.3f or %.3f < %.3f)", delivered, s.delivered, received, s.received)
+			return false
+		}
+		log.Print("Summation decreased repeatedly, accepting it as a meter reset")
+	}
+	s.lowerReadings = 0
+	s.delivered, s.received, s.haveSummation = delivered, received, true
+	return true
+}
+
+// summation returns the last accepted totals, zero before the first.
+func (s *meterState) summation() (delivered, received float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delivered, s.received
+}
+
+func (s *meterState) setScale(mult, div float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mult, s.div = mult, div
+}
+
+func (s *meterState) setDisplay(d summationDisplay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.display = d
+}
+
+func (s *meterState) displayFormat() summationDisplay {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.display
+}
+
+func (s *meterState) scale() (mult, div float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mult, s.div
+}
+
+func (s *meterState) seed(delivered, received *float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.haveSummation {
+		return
+	}
+	if delivered != nil {
+		s.delivered = *delivered
+	}
+	if received != nil {
+		s.received = *received
+	}
+	s.haveSummation = true
+}
+
+// Stateless deployments can use the broker as their store: the retained
+// summation topics hold the last published totals, and with DAILY_ENERGY
+// the retained meter_energy_delivered_today topics hold today's figure.
+// Only the first device is seeded.
+func seedFromBroker(m mqtt.Client) {
+	if !viper.GetBool("SEED_FROM_BROKER") {
+		return
+	}
+
+	deliveredTopic := stateTopic(primaryDevice().id("total_energy_delivered"))
+	receivedTopic := stateTopic(primaryDevice().id("total_energy_received"))
+	todayTopic := stateTopic("meter_energy_delivered_today")
+	todayAttributesTopic := attributesTopic("meter_energy_delivered_today")
+	topics := map[string]byte{deliveredTopic: 0, receivedTopic: 0}
+	if viper.GetBool("DAILY_ENERGY") {
+		topics[todayTopic] = 0
+		topics[todayAttributesTopic] = 0
+	}
+	values := make(chan mqtt.Message, len(topics))
+
+	token := m.SubscribeMultiple(topics, func(_ mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() {
+			return
+		}
+		select {
+		case values <- msg:
+		default:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Print("Failed subscribing to retained summation: ", token.Error())
+		return
+	}
+	defer func() {
+		for topic := range topics {
+			m.Unsubscribe(topic)
+		}
+	}()
+
+	retained := map[string][]byte{}
+	timeout := clock.After(viper.GetDuration("SEED_TIMEOUT"))
+wait:
+	for len(retained) < len(topics) {
+		select {
+		case msg := <-values:
+			retained[msg.Topic()] = msg.Payload()
+		case <-timeout:
+			break wait
+		}
+	}
+
+	delivered := retainedEnergy(deliveredTopic, retained[deliveredTopic])
+	received := retainedEnergy(receivedTopic, retained[receivedTopic])
+	if delivered == nil && received == nil {
+		log.Print("No retained summation found on the broker")
+	} else {
+		if delivered != nil && received != nil {
+			log.Printf("Seeded summation from broker: delivered %.3f, received %.3f", *delivered, *received)
+		}
+		state.seed(delivered, received)
+	}
+	if viper.GetBool("DAILY_ENERGY") {
+		seedDailyEnergy(delivered, retainedEnergy(todayTopic, retained[todayTopic]), retained[todayAttributesTopic])
+	}
+}
+
+// retainedEnergy parses a retained energy total, published in ENERGY_UNIT,
+// as kWh. It returns nil if there was none or it is not a number.
+func retainedEnergy(topic string, payload []byte) *float64 {
+	if payload == nil {
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(payload), 64)
+	if err != nil {
+		log.Printf("Ignoring retained value %q on %s: %v", payload, topic, err)
+		return nil
+	}
+	switch energyUnit() {
+	case "Wh":
+		v /= 1000
+	case "MWh":
+		v *= 1000
+	}
+	return &v
+}
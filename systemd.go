@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as "READY=1" to systemd when the service runs
+// with Type=notify or WatchdogSec; outside systemd NOTIFY_SOCKET is unset
+// and it does nothing.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Print("Failed notifying systemd: ", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Print("Failed notifying systemd: ", err)
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half of WATCHDOG_USEC, but only
+// while frames keep decoding: once none has arrived for a whole watchdog
+// interval the pings stop, and systemd restarts the wedged bridge.
+func runWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	timeout := time.Duration(usec) * time.Microsecond
+	started := clock.Now()
+	ticker := clock.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	stalled := false
+	for range ticker.C() {
+		last := started
+		if ns := health.lastFrame.Load(); ns != 0 {
+			last = time.Unix(0, ns)
+		}
+		if silent := clock.Now().Sub(last); silent > timeout {
+			if !stalled {
+				log.Printf("No frame decoded for %s, stopping watchdog pings", silent.Round(time.Second))
+				stalled = true
+			}
+			continue
+		}
+		stalled = false
+		sdNotify("WATCHDOG=1")
+	}
+}
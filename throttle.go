@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// publishThrottle caps how often a topic is published to at
+// PUBLISH_MIN_INTERVAL. Values arriving in between are coalesced: the most
+// recent one is held and sent once the interval has elapsed, so the final
+// value of a burst is never lost.
+type publishThrottle struct {
+	mu     sync.Mutex
+	topics map[string]*throttledTopic
+}
+
+type throttledTopic struct {
+	last    time.Time
+	pending interface{}
+	timer   Timer
+}
+
+var throttle publishThrottle
+
+func (p *publishThrottle) publish(m Publisher, topic string, retained bool, payload interface{}) {
+	interval := viper.GetDuration("PUBLISH_MIN_INTERVAL")
+	if interval <= 0 {
+		publishState(m, topic, retained, payload)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.topics == nil {
+		p.topics = map[string]*throttledTopic{}
+	}
+	t, ok := p.topics[topic]
+	if !ok {
+		t = &throttledTopic{}
+		p.topics[topic] = t
+	}
+
+	now := clock.Now()
+	if t.timer == nil && now.Sub(t.last) >= interval {
+		t.last = now
+		publishState(m, topic, retained, payload)
+		return
+	}
+	t.pending = payload
+	if t.timer == nil {
+		t.timer = clock.AfterFunc(t.last.Add(interval).Sub(now), func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			t.last = clock.Now()
+			t.timer = nil
+			publishState(m, topic, retained, t.pending)
+		})
+	}
+}
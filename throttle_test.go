@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestThrottleCoalescesBurst(t *testing.T) {
+	_, rec := testFrameContext(t)
+	c := useFakeClock(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	viper.Set("PUBLISH_MIN_INTERVAL", 10*time.Second)
+	topic := stateTopic("meter_power_demand")
+
+	throttle.publish(rec, topic, false, "100")
+	for _, v := range []string{"200", "300", "400"} {
+		c.advance(time.Second)
+		throttle.publish(rec, topic, false, v)
+	}
+	if got := strings.Join(rec.states(), ","); got != topic+"=100" {
+		t.Fatalf("published %s during the burst, want only the first value", got)
+	}
+
+	c.advance(6 * time.Second)
+	if got := strings.Join(rec.states(), ","); got != topic+"=100" {
+		t.Fatalf("published %s before the interval elapsed", got)
+	}
+	c.advance(time.Second)
+	if got, _ := rec.last(topic); got != "400" || len(rec.states()) != 2 {
+		t.Fatalf("after the interval published %v, want the burst's last value 400", rec.states())
+	}
+
+	// The interval restarts from the coalesced publish.
+	c.advance(5 * time.Second)
+	throttle.publish(rec, topic, false, "500")
+	if len(rec.states()) != 2 {
+		t.Errorf("published 500 only 5s after 400")
+	}
+	c.advance(5 * time.Second)
+	if got, _ := rec.last(topic); got != "500" {
+		t.Errorf("last value %q, want 500", got)
+	}
+	c.advance(time.Minute)
+	throttle.publish(rec, topic, false, "600")
+	if got, _ := rec.last(topic); got != "600" || len(rec.states()) != 4 {
+		t.Errorf("a value after a quiet spell was held back: %v", rec.states())
+	}
+}
+
+func TestThrottleKeepsTopicsApart(t *testing.T) {
+	_, rec := testFrameContext(t)
+	useFakeClock(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	viper.Set("PUBLISH_MIN_INTERVAL", 10*time.Second)
+
+	throttle.publish(rec, stateTopic("meter_power_demand"), false, "100")
+	throttle.publish(rec, stateTopic("meter_power_demand_avg"), false, "90")
+	if n := len(rec.states()); n != 2 {
+		t.Errorf("published %d values, want one per topic", n)
+	}
+}
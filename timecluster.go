@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+type TimeCluster struct {
+	XMLName     xml.Name `xml:"TimeCluster"`
+	DeviceMacId string   `xml:"DeviceMacId"`
+	MeterMacId  string   `xml:"MeterMacId"`
+	UTCTime     string   `xml:"UTCTime" validate:"required,emuhex"`
+	LocalTime   string   `xml:"LocalTime" validate:"required,emuhex"`
+}
+
+// handleTimeCluster publishes the meter's clock, how far it is from ours,
+// and the UTC offset the meter applies for local time. A meter running in
+// UTC reports the same value for both.
+func handleTimeCluster(fc *frameContext, data []byte) {
+	var timeCluster TimeCluster
+	if err := fc.decode(data, &timeCluster); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	if !fc.dev.primary() {
+		return
+	}
+	utc, err := parseEmuTimestamp(timeCluster.UTCTime)
+	if err != nil {
+		fc.malformed("TimeCluster", err)
+		return
+	}
+	local, err := parseEmuTimestamp(timeCluster.LocalTime)
+	if err != nil {
+		fc.malformed("TimeCluster", err)
+		return
+	}
+	drift := utc.Sub(clock.Now()).Round(time.Second)
+	b, _ := json.Marshal(map[string]string{
+		"local_time": local.Format("2006-01-02T15:04:05"),
+		"utc_offset": formatUTCOffset(local.Sub(utc)),
+	})
+	fc.m.Publish(attributesTopic("meter_clock"), 0, true, b)
+	fc.m.Publish(stateTopic("meter_clock"), 0, true, formatTimestamp(utc))
+	fc.m.Publish(stateTopic("meter_clock_drift"), 0, true, strconv.FormatFloat(drift.Seconds(), 'f', 0, 64))
+}
+
+// formatUTCOffset renders an offset like "-05:00".
+func formatUTCOffset(d time.Duration) string {
+	sign := "+"
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%s%02d:%02d", sign, int(d.Hours()), int(d.Minutes())%60)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeClusterDrift(t *testing.T) {
+	fc, rec := testFrameContext(t)
+	// 0x2c3a1b00 is 2023-07-07T00:38:24Z; the meter runs 90s behind.
+	useFakeClock(t, time.Date(2023, 7, 7, 0, 39, 54, 0, time.UTC))
+	dispatchFrame(fc, []byte(timeFrame))
+
+	if got, _ := rec.last(stateTopic("meter_clock")); got != "2023-07-07T00:38:24Z" {
+		t.Errorf("meter_clock = %q", got)
+	}
+	if got, _ := rec.last(stateTopic("meter_clock_drift")); got != "-90" {
+		t.Errorf("meter_clock_drift = %q, want -90", got)
+	}
+}
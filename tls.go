@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// certReloader re-reads the MQTT client certificate and CA whenever their
+// files change on disk, so rotated certificates (e.g. from cert-manager) are
+// picked up on the next handshake without restarting the bridge. Files are
+// checked lazily on each handshake; if a rotated file fails to parse the
+// previously loaded one stays in use.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	pool    *x509.CertPool
+	caMod   time.Time
+}
+
+func modTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mod, err := modTime(r.certFile, r.keyFile)
+	if err != nil || (r.cert != nil && mod.Equal(r.certMod)) {
+		if r.cert == nil {
+			return nil, err
+		}
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+		log.Print("Keeping previous MQTT client certificate: ", err)
+		return r.cert, nil
+	}
+	if r.cert != nil {
+		log.Print("Reloaded MQTT client certificate")
+	}
+	r.cert, r.certMod = &cert, mod
+	return r.cert, nil
+}
+
+func (r *certReloader) roots() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mod, err := modTime(r.caFile)
+	if err != nil || (r.pool != nil && mod.Equal(r.caMod)) {
+		if r.pool == nil {
+			return nil, err
+		}
+		return r.pool, nil
+	}
+	pool := x509.NewCertPool()
+	ca, err := os.ReadFile(r.caFile)
+	if err == nil && !pool.AppendCertsFromPEM(ca) {
+		err = fmt.Errorf("no certificates found in %s", r.caFile)
+	}
+	if err != nil {
+		if r.pool == nil {
+			return nil, err
+		}
+		log.Print("Keeping previous MQTT CA certificate: ", err)
+		return r.pool, nil
+	}
+	if r.pool != nil {
+		log.Print("Reloaded MQTT CA certificate")
+	}
+	r.pool, r.caMod = pool, mod
+	return r.pool, nil
+}
+
+// verify checks the broker's chain against the current CA pool. It stands in
+// for the standard verification, which can only use a fixed RootCAs.
+func (r *certReloader) verify(cs tls.ConnectionState) error {
+	roots, err := r.roots()
+	if err != nil {
+		return err
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("broker presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// mqttTLSConfig builds the TLS settings for the broker connection, or nil
+// when MQTT_TLS is off.
+func mqttTLSConfig() (*tls.Config, error) {
+	if !viper.GetBool("MQTT_TLS") {
+		return nil, nil
+	}
+	r := &certReloader{
+		certFile: viper.GetString("MQTT_CLIENT_CERT"),
+		keyFile:  viper.GetString("MQTT_CLIENT_KEY"),
+		caFile:   viper.GetString("MQTT_CA_CERT"),
+	}
+	if (r.certFile == "") != (r.keyFile == "") {
+		return nil, fmt.Errorf("MQTT_CLIENT_CERT and MQTT_CLIENT_KEY must be set together for mutual TLS")
+	}
+	config := &tls.Config{ServerName: viper.GetString("MQTT_HOST")}
+	if r.certFile != "" {
+		if _, err := r.certificate(); err != nil {
+			return nil, fmt.Errorf("loading MQTT client certificate: %w", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		}
+	}
+	if r.caFile != "" {
+		if _, err := r.roots(); err != nil {
+			return nil, fmt.Errorf("loading MQTT CA certificate: %w", err)
+		}
+		// Verification is done in VerifyConnection against the reloaded
+		// pool instead.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = r.verify
+	}
+	return config, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log/slog"
+	"strings"
+)
+
+type CurrentPeriodUsage struct {
+	XMLName      xml.Name `xml:"CurrentPeriodUsage"`
+	DeviceMacId  string   `xml:"DeviceMacId"`
+	MeterMacId   string   `xml:"MeterMacId"`
+	TimeStamp    string   `xml:"TimeStamp"`
+	CurrentUsage string   `xml:"CurrentUsage" validate:"required,emuhex"`
+	Multiplier   string   `xml:"Multiplier" validate:"required,emuhex"`
+	Divisor      string   `xml:"Divisor" validate:"required,emuhex"`
+	DigitsRight  string   `xml:"DigitsRight"`
+	DigitsLeft   string   `xml:"DigitsLeft"`
+	StartDate    string   `xml:"StartDate"`
+}
+
+type LastPeriodUsage struct {
+	XMLName     xml.Name `xml:"LastPeriodUsage"`
+	DeviceMacId string   `xml:"DeviceMacId"`
+	MeterMacId  string   `xml:"MeterMacId"`
+	LastUsage   string   `xml:"LastUsage" validate:"required,emuhex"`
+	Multiplier  string   `xml:"Multiplier" validate:"required,emuhex"`
+	Divisor     string   `xml:"Divisor" validate:"required,emuhex"`
+	DigitsRight string   `xml:"DigitsRight"`
+	DigitsLeft  string   `xml:"DigitsLeft"`
+	StartDate   string   `xml:"StartDate"`
+	EndDate     string   `xml:"EndDate"`
+}
+
+// allOnes reports whether a hex field is the Zigbee SE "invalid" value,
+// every bit set.
+func allOnes(s string) bool {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	return s != "" && strings.Trim(s, "fF") == ""
+}
+
+func handleCurrentPeriodUsage(fc *frameContext, data []byte) {
+	var usage CurrentPeriodUsage
+	if err := fc.decode(data, &usage); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	publishPeriodUsage(fc, "CurrentPeriodUsage", "current_period_usage", usage.CurrentUsage, usage.Multiplier, usage.Divisor,
+		map[string]string{"start_date": usage.StartDate})
+}
+
+func handleLastPeriodUsage(fc *frameContext, data []byte) {
+	var usage LastPeriodUsage
+	if err := fc.decode(data, &usage); err != nil {
+		slog.Warn("Skipping incomplete XML", "err", err)
+		return
+	}
+	publishPeriodUsage(fc, "LastPeriodUsage", "last_period_usage", usage.LastUsage, usage.Multiplier, usage.Divisor,
+		map[string]string{"start_date": usage.StartDate, "end_date": usage.EndDate})
+}
+
+// publishPeriodUsage decodes a billing-period accumulator like a summation
+// and publishes it with the period's dates as attributes.
+func publishPeriodUsage(fc *frameContext, frame, suffix, value, multiplier, divisor string, dates map[string]string) {
+	if allOnes(value) {
+		slog.Debug("Skipping invalid period usage", "frame", frame)
+		return
+	}
+	v, err := parseHex(value)
+	if err != nil {
+		fc.malformed(frame, err)
+		return
+	}
+	mult, div, err := parseScale(multiplier, divisor)
+	if err != nil {
+		fc.malformed(frame, err)
+		return
+	}
+	kwh := float64(v) * mult / div
+
+	attrs := map[string]interface{}{}
+	for name, date := range dates {
+		attrs[name] = nil
+		if t, err := parseEmuTimestamp(date); err == nil && !allOnes(date) {
+			attrs[name] = formatTimestamp(t)
+		}
+	}
+	b, _ := json.Marshal(attrs)
+	id := fc.dev.id(suffix)
+	fc.m.Publish(attributesTopic(id), 0, true, b)
+	fc.m.Publish(stateTopic(id), 0, true, formatEnergy(kwh))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// A frameVector is a capture in testdata/frames, NAME.xml, with the state
+// each sensor should end up at in NAME.json. Config is set on top of the
+// defaults before the capture is decoded.
+type frameVector struct {
+	Description string                 `json:"description"`
+	Config      map[string]interface{} `json:"config"`
+	States      map[string]string      `json:"states"`
+}
+
+func TestFrameVectors(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "frames", "*.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no frame vectors in testdata/frames")
+	}
+	for _, capture := range captures {
+		name := strings.TrimSuffix(filepath.Base(capture), ".xml")
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(strings.TrimSuffix(capture, ".xml") + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var vector frameVector
+			if err := json.Unmarshal(b, &vector); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fc, rec := testFrameContext(t)
+			for key, value := range vector.Config {
+				viper.Set(key, value)
+			}
+			for _, token := range splitAll(t, string(data)) {
+				dispatchFrame(fc, []byte(token))
+			}
+			for id, want := range vector.States {
+				if got, ok := rec.last(stateTopic(id)); !ok {
+					t.Errorf("%s: nothing published, want %q", id, want)
+				} else if got != want {
+					t.Errorf("%s = %q, want %q", id, got, want)
+				}
+			}
+		})
+	}
+}